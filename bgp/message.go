@@ -0,0 +1,239 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// message types, see rfc 4271
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	headerLen = 19
+	maxMsgLen = 4096
+
+	// asTrans stands for 4-octet asns in 2-octet fields, see rfc 6793
+	asTrans = 23456
+
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	afiIPv4     = 1
+	safiUnicast = 1
+
+	attrFlagOptional   = 0x80
+	attrFlagTransitive = 0x40
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+	attrAS4Path   = 17
+
+	originIGP        = 0
+	asSequence       = 2
+	defaultLocalPref = 100
+
+	// notification codes and subcodes
+	errOpenMessage          = 2
+	errBadPeerAS            = 2
+	errUnacceptableHoldTime = 6
+	errHoldTimeExpired      = 4
+	errCease                = 6
+	errAdminShutdown        = 2
+)
+
+// message is a bgp message without the header.
+type message struct {
+	kind byte
+	body []byte
+}
+
+func writeMessage(w io.Writer, kind byte, body []byte) error {
+	buf := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		buf[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(buf[16:], uint16(headerLen+len(body)))
+	buf[18] = kind
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 16; i++ {
+		if header[i] != 0xff {
+			return nil, fmt.Errorf("bad marker")
+		}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < headerLen || length > maxMsgLen {
+		return nil, fmt.Errorf("bad message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &message{kind: header[18], body: body}, nil
+}
+
+// open is an open message.
+type open struct {
+	asn      uint32
+	holdTime uint16
+	routerID net.IP
+	// fourOctetAS tells whether the sender supports 4-octet asns, in which
+	// case asn is the one of the capability.
+	fourOctetAS bool
+}
+
+func (o *open) marshal() []byte {
+	var caps bytes.Buffer
+	// multiprotocol ipv4 unicast
+	caps.Write([]byte{capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast})
+	caps.Write([]byte{capFourOctetAS, 4})
+	binary.Write(&caps, binary.BigEndian, o.asn)
+
+	var buf bytes.Buffer
+	buf.WriteByte(4)
+	myAS := uint16(asTrans)
+	if o.asn <= 0xffff {
+		myAS = uint16(o.asn)
+	}
+	binary.Write(&buf, binary.BigEndian, myAS)
+	binary.Write(&buf, binary.BigEndian, o.holdTime)
+	buf.Write(o.routerID.To4())
+	// a single capabilities parameter
+	buf.WriteByte(byte(2 + caps.Len()))
+	buf.WriteByte(2)
+	buf.WriteByte(byte(caps.Len()))
+	buf.Write(caps.Bytes())
+	return buf.Bytes()
+}
+
+func parseOpen(body []byte) (*open, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("short open message")
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("unsupported bgp version %d", body[0])
+	}
+	o := &open{
+		asn:      uint32(binary.BigEndian.Uint16(body[1:])),
+		holdTime: binary.BigEndian.Uint16(body[3:]),
+		routerID: net.IP(body[5:9]),
+	}
+	params := body[10:]
+	if len(params) != int(body[9]) {
+		return nil, fmt.Errorf("bad optional parameters length")
+	}
+	for len(params) >= 2 {
+		kind, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			return nil, fmt.Errorf("bad optional parameter length")
+		}
+		if kind == 2 {
+			caps := params[2 : 2+length]
+			for len(caps) >= 2 {
+				code, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return nil, fmt.Errorf("bad capability length")
+				}
+				if code == capFourOctetAS && capLen == 4 {
+					o.fourOctetAS = true
+					o.asn = binary.BigEndian.Uint32(caps[2:])
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+		params = params[2+length:]
+	}
+	return o, nil
+}
+
+// update is an update message of ipv4 unicast prefixes.
+type update struct {
+	withdrawn []*net.IPNet
+	nlri      []*net.IPNet
+	// path attributes of nlri
+	asn         uint32
+	ebgp        bool
+	nextHop     net.IP
+	fourOctetAS bool
+}
+
+func (u *update) marshal() []byte {
+	var withdrawn bytes.Buffer
+	for _, prefix := range u.withdrawn {
+		writePrefix(&withdrawn, prefix)
+	}
+
+	var attrs bytes.Buffer
+	if len(u.nlri) > 0 {
+		writeAttr(&attrs, attrFlagTransitive, attrOrigin, []byte{originIGP})
+		writeAttr(&attrs, attrFlagTransitive, attrASPath, u.asPath(u.fourOctetAS))
+		if u.ebgp && !u.fourOctetAS && u.asn > 0xffff {
+			writeAttr(&attrs, attrFlagOptional|attrFlagTransitive, attrAS4Path, u.asPath(true))
+		}
+		writeAttr(&attrs, attrFlagTransitive, attrNextHop, u.nextHop.To4())
+		if !u.ebgp {
+			localPref := make([]byte, 4)
+			binary.BigEndian.PutUint32(localPref, defaultLocalPref)
+			writeAttr(&attrs, attrFlagTransitive, attrLocalPref, localPref)
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(withdrawn.Len()))
+	buf.Write(withdrawn.Bytes())
+	binary.Write(&buf, binary.BigEndian, uint16(attrs.Len()))
+	buf.Write(attrs.Bytes())
+	for _, prefix := range u.nlri {
+		writePrefix(&buf, prefix)
+	}
+	return buf.Bytes()
+}
+
+// asPath returns the as path of the speaker, empty to internal peers.
+func (u *update) asPath(fourOctet bool) []byte {
+	if !u.ebgp {
+		return nil
+	}
+	if fourOctet {
+		path := []byte{asSequence, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(path[2:], u.asn)
+		return path
+	}
+	asn := uint16(asTrans)
+	if u.asn <= 0xffff {
+		asn = uint16(u.asn)
+	}
+	path := []byte{asSequence, 1, 0, 0}
+	binary.BigEndian.PutUint16(path[2:], asn)
+	return path
+}
+
+func writeAttr(buf *bytes.Buffer, flags, kind byte, value []byte) {
+	buf.Write([]byte{flags, kind, byte(len(value))})
+	buf.Write(value)
+}
+
+func writePrefix(buf *bytes.Buffer, prefix *net.IPNet) {
+	ones, _ := prefix.Mask.Size()
+	buf.WriteByte(byte(ones))
+	buf.Write(prefix.IP.To4()[:(ones+7)/8])
+}
+
+func notification(code, subcode byte) []byte {
+	return []byte{code, subcode}
+}
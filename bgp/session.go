@@ -0,0 +1,290 @@
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	// writeTimeout bounds every write, so that a peer not reading can't
+	// block the session, e.g. from being stopped
+	writeTimeout = 10 * time.Second
+	// openHoldTime bounds the wait for the open and keepalive of the peer,
+	// as suggested by rfc 4271
+	openHoldTime = 4 * time.Minute
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+// session is the connection to a neighbor, advertising the prefixes of the
+// speaker.
+type session struct {
+	local    Config
+	neighbor Neighbor
+	// prefixes are the prefixes to advertise, only accessed by run
+	prefixes []*net.IPNet
+
+	// prefixCh holds the latest prefixes set, not taken by run yet
+	prefixCh chan []*net.IPNet
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+func newSession(local Config, neighbor Neighbor, prefixes []*net.IPNet) *session {
+	return &session{
+		local:    local,
+		neighbor: neighbor,
+		prefixes: prefixes,
+		prefixCh: make(chan []*net.IPNet, 1),
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// setPrefixes makes the session advertise prefixes once established,
+// replacing the ones set before. It must not be called concurrently.
+func (s *session) setPrefixes(prefixes []*net.IPNet) {
+	select {
+	case <-s.prefixCh:
+	default:
+	}
+	s.prefixCh <- prefixes
+}
+
+// stop closes the session with a cease notification, and waits for it.
+func (s *session) stop() {
+	close(s.stopCh)
+	<-s.done
+}
+
+// run connects to the neighbor, and reconnects with backoff until stopped.
+func (s *session) run() {
+	defer close(s.done)
+	defer sessionEstablished.WithLabelValues(s.neighbor.String()).Set(0)
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		err := s.connect()
+		sessionEstablished.WithLabelValues(s.neighbor.String()).Set(0)
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+		log.Warningf("bgp: session to %s is down: %v", s.neighbor, err)
+		if time.Since(start) > maxBackoff {
+			backoff = minBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.stopCh:
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connect establishes the session, and serves it until it fails or is
+// stopped.
+func (s *session) connect() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-s.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	dialer := net.Dialer{Timeout: connectTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.neighbor.Address)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// connDone stops the reader once the connection is not served anymore
+	connDone := make(chan struct{})
+	defer close(connDone)
+	msgCh := make(chan *message)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := readMessage(conn)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case msgCh <- msg:
+			case <-connDone:
+				return
+			}
+		}
+	}()
+
+	holdTime := uint16(s.local.HoldTime / time.Second)
+	local := &open{asn: s.local.ASN, holdTime: holdTime, routerID: s.local.RouterID}
+	if err := write(conn, msgOpen, local.marshal()); err != nil {
+		return err
+	}
+	msg, err := s.receive(msgCh, errCh, openHoldTime)
+	if err != nil {
+		return err
+	}
+	if msg.kind != msgOpen {
+		return fmt.Errorf("expect open, got message of type %d", msg.kind)
+	}
+	peer, err := parseOpen(msg.body)
+	if err != nil {
+		write(conn, msgNotification, notification(errOpenMessage, 0))
+		return err
+	}
+	if peer.asn != s.neighbor.ASN {
+		write(conn, msgNotification, notification(errOpenMessage, errBadPeerAS))
+		return fmt.Errorf("peer as %d, expect %d", peer.asn, s.neighbor.ASN)
+	}
+	// rfc 4271 allows a hold time of zero or at least three seconds
+	if peer.holdTime == 1 || peer.holdTime == 2 {
+		write(conn, msgNotification, notification(errOpenMessage, errUnacceptableHoldTime))
+		return fmt.Errorf("unacceptable peer hold time %ds", peer.holdTime)
+	}
+	if peer.holdTime < holdTime {
+		holdTime = peer.holdTime
+	}
+	if err := write(conn, msgKeepalive, nil); err != nil {
+		return err
+	}
+	if msg, err = s.receive(msgCh, errCh, openHoldTime); err != nil {
+		return err
+	}
+	if msg.kind != msgKeepalive {
+		return fmt.Errorf("expect keepalive, got message of type %d", msg.kind)
+	}
+
+	log.Infof("bgp: session to %s (router id %s) is established, hold time %ds", s.neighbor, peer.routerID, holdTime)
+	sessionEstablished.WithLabelValues(s.neighbor.String()).Set(1)
+	// take the prefixes set while the session was down
+	select {
+	case s.prefixes = <-s.prefixCh:
+	default:
+	}
+	advertised := make(map[string]*net.IPNet)
+	if err := s.sync(conn, peer, advertised); err != nil {
+		return err
+	}
+
+	// a hold time of zero disables keepalives and the hold timer
+	var keepalive <-chan time.Time
+	var hold *time.Timer
+	holdCh := make(<-chan time.Time)
+	if holdTime > 0 {
+		ticker := time.NewTicker(time.Duration(holdTime) * time.Second / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+		hold = time.NewTimer(time.Duration(holdTime) * time.Second)
+		defer hold.Stop()
+		holdCh = hold.C
+	}
+	for {
+		select {
+		case s.prefixes = <-s.prefixCh:
+			if err := s.sync(conn, peer, advertised); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if err := write(conn, msgKeepalive, nil); err != nil {
+				return err
+			}
+		case msg := <-msgCh:
+			if hold != nil {
+				hold.Reset(time.Duration(holdTime) * time.Second)
+			}
+			if msg.kind == msgNotification {
+				return fmt.Errorf("notification from peer: %v", msg.body)
+			}
+			// routes of the peer are ignored, the speaker only advertises
+		case err := <-errCh:
+			return err
+		case <-holdCh:
+			write(conn, msgNotification, notification(errHoldTimeExpired, 0))
+			return fmt.Errorf("hold timer expired")
+		case <-s.stopCh:
+			log.Infof("bgp: close session to %s", s.neighbor)
+			return write(conn, msgNotification, notification(errCease, errAdminShutdown))
+		}
+	}
+}
+
+// write writes a message to conn within writeTimeout.
+func write(conn net.Conn, kind byte, body []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return writeMessage(conn, kind, body)
+}
+
+func (s *session) receive(msgCh <-chan *message, errCh <-chan error, timeout time.Duration) (*message, error) {
+	select {
+	case msg := <-msgCh:
+		if msg.kind == msgNotification {
+			return nil, fmt.Errorf("notification from peer: %v", msg.body)
+		}
+		return msg, nil
+	case err := <-errCh:
+		return nil, err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for peer")
+	case <-s.stopCh:
+		return nil, fmt.Errorf("stopped")
+	}
+}
+
+// sync advertises the prefixes of the session not advertised yet, and
+// withdraws the advertised ones removed since.
+func (s *session) sync(conn net.Conn, peer *open, advertised map[string]*net.IPNet) error {
+	current := make(map[string]*net.IPNet)
+	for _, prefix := range s.prefixes {
+		current[prefix.String()] = prefix
+	}
+	u := &update{
+		asn:         s.local.ASN,
+		ebgp:        s.local.ASN != s.neighbor.ASN,
+		nextHop:     s.local.RouterID,
+		fourOctetAS: peer.fourOctetAS,
+	}
+	for key, prefix := range advertised {
+		if current[key] == nil {
+			u.withdrawn = append(u.withdrawn, prefix)
+		}
+	}
+	for key, prefix := range current {
+		if advertised[key] == nil {
+			u.nlri = append(u.nlri, prefix)
+		}
+	}
+	if len(u.withdrawn) == 0 && len(u.nlri) == 0 {
+		return nil
+	}
+	if err := write(conn, msgUpdate, u.marshal()); err != nil {
+		return err
+	}
+	for _, prefix := range u.withdrawn {
+		log.Infof("bgp: withdrew %s from %s", prefix, s.neighbor)
+		prefixUpdates.WithLabelValues(s.neighbor.String(), "withdraw").Inc()
+		delete(advertised, prefix.String())
+	}
+	for _, prefix := range u.nlri {
+		log.Infof("bgp: advertised %s to %s", prefix, s.neighbor)
+		prefixUpdates.WithLabelValues(s.neighbor.String(), "advertise").Inc()
+		advertised[prefix.String()] = prefix
+	}
+	return nil
+}
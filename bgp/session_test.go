@@ -0,0 +1,172 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPeer is a bgp neighbor listening on the loopback.
+type testPeer struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPeer{t: t, listener: listener}
+}
+
+func (p *testPeer) close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.listener.Close()
+}
+
+func (p *testPeer) neighbor(asn uint32) Neighbor {
+	return Neighbor{Address: p.listener.Addr().String(), ASN: asn}
+}
+
+func (p *testPeer) accept() {
+	conn, err := p.listener.Accept()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	p.conn = conn
+}
+
+func (p *testPeer) write(kind byte, body []byte) {
+	if err := writeMessage(p.conn, kind, body); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// read returns the next message other than a keepalive, unless kind is
+// msgKeepalive.
+func (p *testPeer) read(kind byte) *message {
+	for {
+		msg, err := readMessage(p.conn)
+		if err != nil {
+			p.t.Fatalf("failed to read message of type %d: %v", kind, err)
+		}
+		if msg.kind == msgKeepalive && kind != msgKeepalive {
+			continue
+		}
+		if msg.kind != kind {
+			p.t.Fatalf("expect message of type %d, got %d: %v", kind, msg.kind, msg.body)
+		}
+		return msg
+	}
+}
+
+// establish answers the open of the speaker with one holding holdTime.
+func (p *testPeer) establish(asn uint32, holdTime uint16) *open {
+	p.accept()
+	local, err := parseOpen(p.read(msgOpen).body)
+	if err != nil {
+		p.t.Fatalf("invalid open: %v", err)
+	}
+	p.write(msgOpen, (&open{asn: asn, holdTime: holdTime, routerID: net.ParseIP("10.0.0.2")}).marshal())
+	return local
+}
+
+// parseUpdate returns the withdrawn routes and nlri of an update.
+func parseUpdate(t *testing.T, body []byte) (withdrawn, nlri []string) {
+	length := int(binary.BigEndian.Uint16(body))
+	withdrawn = parsePrefixes(t, body[2:2+length])
+	body = body[2+length:]
+	length = int(binary.BigEndian.Uint16(body))
+	nlri = parsePrefixes(t, body[2+length:])
+	return withdrawn, nlri
+}
+
+func parsePrefixes(t *testing.T, b []byte) []string {
+	var prefixes []string
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if len(b) < 1+n {
+			t.Fatalf("bad prefix length %d", ones)
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String())
+		b = b[1+n:]
+	}
+	return prefixes
+}
+
+func TestSession(t *testing.T) {
+	peer := newTestPeer(t)
+	defer peer.close()
+
+	_, podCIDR, _ := net.ParseCIDR("172.16.1.0/24")
+	speaker := NewSpeaker()
+	speaker.SetPrefixes([]*net.IPNet{podCIDR})
+	speaker.SetConfig(Config{
+		ASN:       65000,
+		RouterID:  net.ParseIP("10.0.0.1"),
+		Neighbors: []Neighbor{peer.neighbor(65001)},
+	})
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		speaker.Run(stopCh)
+		close(stopped)
+	}()
+
+	local := peer.establish(65001, 90)
+	if local.asn != 65000 || !local.routerID.Equal(net.ParseIP("10.0.0.1")) || local.holdTime != 90 || !local.fourOctetAS {
+		t.Errorf("unexpected open %+v", local)
+	}
+	peer.read(msgKeepalive)
+	peer.write(msgKeepalive, nil)
+
+	withdrawn, nlri := parseUpdate(t, peer.read(msgUpdate).body)
+	if len(withdrawn) != 0 || len(nlri) != 1 || nlri[0] != podCIDR.String() {
+		t.Errorf("expect %s advertised, got withdrawn %v nlri %v", podCIDR, withdrawn, nlri)
+	}
+
+	speaker.SetPrefixes(nil)
+	withdrawn, nlri = parseUpdate(t, peer.read(msgUpdate).body)
+	if len(withdrawn) != 1 || withdrawn[0] != podCIDR.String() || len(nlri) != 0 {
+		t.Errorf("expect %s withdrawn, got withdrawn %v nlri %v", podCIDR, withdrawn, nlri)
+	}
+
+	close(stopCh)
+	if body := peer.read(msgNotification).body; body[0] != errCease || body[1] != errAdminShutdown {
+		t.Errorf("expect cease, got notification %v", body)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("speaker is not stopped")
+	}
+}
+
+func TestUnacceptableHoldTime(t *testing.T) {
+	peer := newTestPeer(t)
+	defer peer.close()
+
+	speaker := NewSpeaker()
+	speaker.SetConfig(Config{
+		ASN:       65000,
+		RouterID:  net.ParseIP("10.0.0.1"),
+		Neighbors: []Neighbor{peer.neighbor(65001)},
+	})
+	stopCh := make(chan struct{})
+	defer speaker.Run(stopCh)
+	defer close(stopCh)
+
+	peer.establish(65001, 2)
+	if body := peer.read(msgNotification).body; body[0] != errOpenMessage || body[1] != errUnacceptableHoldTime {
+		t.Errorf("expect unacceptable hold time, got notification %v", body)
+	}
+}
@@ -0,0 +1,168 @@
+// Package bgp implements a minimal bgp speaker advertising the pod cidrs of
+// the node to its neighbors, e.g. top of rack routers. It only establishes
+// sessions actively, advertises ipv4 unicast prefixes with the node as next
+// hop, and ignores routes of neighbors.
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultPort     = 179
+	DefaultHoldTime = 90 * time.Second
+)
+
+var (
+	sessionEstablished = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "bgp_session_established",
+		Help:      "Whether the bgp session to a neighbor is established.",
+	}, []string{"neighbor"})
+	prefixUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "bgp_prefix_updates_total",
+		Help:      "Number of prefixes advertised to or withdrawn from a neighbor.",
+	}, []string{"neighbor", "action"})
+)
+
+func init() {
+	prometheus.MustRegister(sessionEstablished, prefixUpdates)
+}
+
+// Neighbor is a bgp peer of the speaker.
+type Neighbor struct {
+	// Address is host:port of the neighbor.
+	Address string
+	ASN     uint32
+}
+
+func (n Neighbor) String() string {
+	return fmt.Sprintf("%d@%s", n.ASN, n.Address)
+}
+
+// ParseNeighbor parses asn@host, or asn@host:port for a port other than
+// 179, e.g. 65001@10.0.0.1 or 65001@127.0.0.1:1790.
+func ParseNeighbor(s string) (Neighbor, error) {
+	i := strings.Index(s, "@")
+	if i <= 0 {
+		return Neighbor{}, fmt.Errorf("invalid bgp neighbor %q, expect asn@host[:port]", s)
+	}
+	asn, err := strconv.ParseUint(s[:i], 10, 32)
+	if err != nil || asn == 0 {
+		return Neighbor{}, fmt.Errorf("invalid asn of bgp neighbor %q", s)
+	}
+	address := s[i+1:]
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), strconv.Itoa(DefaultPort)
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return Neighbor{}, fmt.Errorf("invalid ipv4 address of bgp neighbor %q", s)
+	}
+	return Neighbor{Address: net.JoinHostPort(host, port), ASN: uint32(asn)}, nil
+}
+
+// Config holds the settings of a Speaker.
+type Config struct {
+	// ASN is the as of the speaker.
+	ASN uint32
+	// RouterID is the bgp identifier of the speaker, also the next hop of
+	// the prefixes, e.g. the node ip.
+	RouterID net.IP
+	// HoldTime is the proposed hold time.
+	HoldTime time.Duration
+	// Neighbors are the peers to advertise the prefixes to.
+	Neighbors []Neighbor
+}
+
+// Speaker advertises prefixes to the neighbors of its config.
+type Speaker struct {
+	lock     sync.Mutex
+	config   Config
+	prefixes []*net.IPNet
+	sessions map[Neighbor]*session
+}
+
+// NewSpeaker returns a Speaker without neighbors, see SetConfig.
+func NewSpeaker() *Speaker {
+	return &Speaker{sessions: make(map[Neighbor]*session)}
+}
+
+// SetConfig connects to the neighbors of config, and disconnects from the
+// others. Sessions are restarted if the settings of the speaker changed.
+func (s *Speaker) SetConfig(config Config) {
+	if config.HoldTime <= 0 {
+		config.HoldTime = DefaultHoldTime
+	}
+	// sessions are stopped without the lock, as a stopping session may
+	// wait for its cease notification to be written
+	for _, session := range s.setConfig(config) {
+		session.stop()
+	}
+}
+
+// setConfig starts the sessions of config, and returns the ones to stop.
+func (s *Speaker) setConfig(config Config) []*session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reflect.DeepEqual(config, s.config) {
+		return nil
+	}
+	restart := config.ASN != s.config.ASN || !config.RouterID.Equal(s.config.RouterID) || config.HoldTime != s.config.HoldTime
+	s.config = config
+
+	wanted := make(map[Neighbor]bool)
+	for _, neighbor := range config.Neighbors {
+		wanted[neighbor] = true
+	}
+	var stopped []*session
+	for neighbor, session := range s.sessions {
+		if restart || !wanted[neighbor] {
+			stopped = append(stopped, session)
+			delete(s.sessions, neighbor)
+		}
+	}
+	if config.ASN == 0 || config.RouterID.To4() == nil {
+		return stopped
+	}
+	for neighbor := range wanted {
+		if _, ok := s.sessions[neighbor]; ok {
+			continue
+		}
+		session := newSession(config, neighbor, s.prefixes)
+		s.sessions[neighbor] = session
+		go session.run()
+	}
+	return stopped
+}
+
+// SetPrefixes updates the prefixes to advertise, withdrawing removed ones.
+func (s *Speaker) SetPrefixes(prefixes []*net.IPNet) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prefixes = prefixes
+	for _, session := range s.sessions {
+		session.setPrefixes(prefixes)
+	}
+}
+
+// Run closes every session when stopCh is closed.
+func (s *Speaker) Run(stopCh <-chan struct{}) {
+	<-stopCh
+	s.lock.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[Neighbor]*session)
+	s.lock.Unlock()
+	for _, session := range sessions {
+		session.stop()
+	}
+}
@@ -0,0 +1,42 @@
+package bgp
+
+import (
+	"testing"
+)
+
+func TestParseNeighbor(t *testing.T) {
+	for _, c := range []struct {
+		spec   string
+		expect Neighbor
+		err    bool
+	}{
+		{spec: "65001@10.0.0.1", expect: Neighbor{Address: "10.0.0.1:179", ASN: 65001}},
+		{spec: "65001@10.0.0.1:1790", expect: Neighbor{Address: "10.0.0.1:1790", ASN: 65001}},
+		{spec: "4200000000@10.0.0.1", expect: Neighbor{Address: "10.0.0.1:179", ASN: 4200000000}},
+		{spec: "10.0.0.1", err: true},
+		{spec: "@10.0.0.1", err: true},
+		{spec: "0@10.0.0.1", err: true},
+		{spec: "as65001@10.0.0.1", err: true},
+		{spec: "4294967296@10.0.0.1", err: true},
+		{spec: "65001@", err: true},
+		{spec: "65001@10.0.0.256", err: true},
+		{spec: "65001@router.local", err: true},
+		{spec: "65001@fd00::1", err: true},
+		{spec: "65001@[fd00::1]:179", err: true},
+	} {
+		neighbor, err := ParseNeighbor(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expect error, got %+v", c.spec, neighbor)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+			continue
+		}
+		if neighbor != c.expect {
+			t.Errorf("%q: expect %+v, got %+v", c.spec, c.expect, neighbor)
+		}
+	}
+}
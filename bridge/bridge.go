@@ -0,0 +1,299 @@
+// Package bridge keeps the pod bridge converged to the settings the bridge
+// plugin would create it with, so that it exists before the first pod and
+// survives changes made by others.
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	DefaultCheckInterval = time.Minute
+)
+
+var bridgeRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "bridge_repairs_total",
+	Help:      "Number of changes made to converge the pod bridge by item.",
+}, []string{"item"})
+
+func init() {
+	prometheus.MustRegister(bridgeRepairs)
+}
+
+// Config holds the desired settings of the bridge.
+type Config struct {
+	// Name is the name of the bridge, the same as in the conflist.
+	Name string
+	// MTU is the mtu of the bridge, the same as in the conflist.
+	MTU int
+	// Promisc makes the bridge promiscuous for hairpin packets.
+	Promisc bool
+	// Hairpin sets hairpin mode on every port of the bridge, and clears it
+	// if false.
+	Hairpin bool
+	// CheckInterval is the interval of converging the bridge besides on
+	// netlink notifications.
+	CheckInterval time.Duration
+}
+
+// Manager creates the bridge with the gateway address of the pod cidr and
+// keeps it converged.
+type Manager struct {
+	name          string
+	mtu           int
+	promisc       bool
+	hairpin       bool
+	checkInterval time.Duration
+
+	podCIDRLock sync.Mutex
+	podCIDR     *net.IPNet
+	// oldPodCIDR is the pod cidr before the last change, whose gateway is
+	// removed from the bridge
+	oldPodCIDR *net.IPNet
+
+	trigger chan struct{}
+
+	// bridgeIndex is the ifindex of the bridge seen by the last converge,
+	// used to find ports being added to the bridge
+	bridgeIndex int
+}
+
+// New returns a Manager of the bridge described by config.
+func New(config Config) *Manager {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	return &Manager{
+		name:          config.Name,
+		mtu:           config.MTU,
+		promisc:       config.Promisc,
+		hairpin:       config.Hairpin,
+		checkInterval: config.CheckInterval,
+		trigger:       make(chan struct{}, 1),
+	}
+}
+
+// SetPodCIDR updates the pod cidr whose gateway is assigned to the bridge,
+// and converges the bridge right away.
+func (m *Manager) SetPodCIDR(cidr *net.IPNet) {
+	m.podCIDRLock.Lock()
+	if m.podCIDR != nil && cidr != nil && m.podCIDR.String() != cidr.String() {
+		m.oldPodCIDR = m.podCIDR
+	}
+	m.podCIDR = cidr
+	m.podCIDRLock.Unlock()
+	m.kick()
+}
+
+func (m *Manager) getPodCIDR() *net.IPNet {
+	m.podCIDRLock.Lock()
+	defer m.podCIDRLock.Unlock()
+	return m.podCIDR
+}
+
+func (m *Manager) getOldPodCIDR() *net.IPNet {
+	m.podCIDRLock.Lock()
+	defer m.podCIDRLock.Unlock()
+	return m.oldPodCIDR
+}
+
+func (m *Manager) kick() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run converges the bridge whenever the pod cidr changes, the bridge, its
+// ports or its addresses are changed, and every check interval.
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	var linkCh chan netlink.LinkUpdate
+	var addrCh chan netlink.AddrUpdate
+	for {
+		// netlink closes the channels on errors, subscribe again
+		if linkCh == nil {
+			linkCh = make(chan netlink.LinkUpdate)
+			if err := netlink.LinkSubscribe(linkCh, stopCh); err != nil {
+				log.Warningf("bridge: failed to subscribe link updates: %v", err)
+				linkCh = nil
+			}
+		}
+		if addrCh == nil {
+			addrCh = make(chan netlink.AddrUpdate)
+			if err := netlink.AddrSubscribe(addrCh, stopCh); err != nil {
+				log.Warningf("bridge: failed to subscribe address updates: %v", err)
+				addrCh = nil
+			}
+		}
+
+		select {
+		case <-m.trigger:
+			m.converge()
+		case <-ticker.C:
+			m.converge()
+		case update, ok := <-linkCh:
+			if !ok {
+				linkCh = nil
+				continue
+			}
+			if update.Link == nil {
+				continue
+			}
+			attrs := update.Link.Attrs()
+			if attrs.Name == m.name || (m.bridgeIndex != 0 && attrs.MasterIndex == m.bridgeIndex) {
+				m.converge()
+			}
+		case update, ok := <-addrCh:
+			if !ok {
+				addrCh = nil
+				continue
+			}
+			if m.isBridgeIndex(update.LinkIndex) {
+				m.converge()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) isBridgeIndex(index int) bool {
+	link, err := netlink.LinkByIndex(index)
+	return err == nil && link.Attrs().Name == m.name
+}
+
+func (m *Manager) converge() {
+	podCIDR := m.getPodCIDR()
+	if podCIDR == nil {
+		return
+	}
+	if err := m.ensureBridge(podCIDR); err != nil {
+		log.Errorf("bridge: failed to converge %s: %v", m.name, err)
+	}
+}
+
+// ensureBridge creates the bridge if missing, and converges its mtu, promisc
+// mode, state, addresses and hairpin mode of its ports.
+func (m *Manager) ensureBridge(podCIDR *net.IPNet) error {
+	link, err := netlink.LinkByName(m.name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return fmt.Errorf("failed to get %s: %v", m.name, err)
+		}
+		log.Infof("bridge: create %s with mtu %d", m.name, m.mtu)
+		br := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   m.name,
+				MTU:    m.mtu,
+				TxQLen: -1,
+			},
+		}
+		if err := netlink.LinkAdd(br); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("failed to create %s: %v", m.name, err)
+		}
+		bridgeRepairs.WithLabelValues("created").Inc()
+		if link, err = netlink.LinkByName(m.name); err != nil {
+			return fmt.Errorf("failed to get %s: %v", m.name, err)
+		}
+	}
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return fmt.Errorf("%s is a %s rather than a bridge", m.name, link.Type())
+	}
+
+	attrs := link.Attrs()
+	m.bridgeIndex = attrs.Index
+	if m.mtu > 0 && attrs.MTU != m.mtu {
+		log.Infof("bridge: set mtu of %s from %d to %d", m.name, attrs.MTU, m.mtu)
+		if err := netlink.LinkSetMTU(link, m.mtu); err != nil {
+			log.Errorf("bridge: failed to set mtu of %s: %v", m.name, err)
+		} else {
+			bridgeRepairs.WithLabelValues("mtu").Inc()
+		}
+	}
+	if promisc := attrs.Promisc != 0; promisc != m.promisc {
+		log.Infof("bridge: set promisc of %s to %t", m.name, m.promisc)
+		if m.promisc {
+			err = netlink.SetPromiscOn(link)
+		} else {
+			err = netlink.SetPromiscOff(link)
+		}
+		if err != nil {
+			log.Errorf("bridge: failed to set promisc of %s: %v", m.name, err)
+		} else {
+			bridgeRepairs.WithLabelValues("promisc").Inc()
+		}
+	}
+	if attrs.Flags&net.FlagUp == 0 {
+		log.Infof("bridge: set %s up", m.name)
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set %s up: %v", m.name, err)
+		}
+		bridgeRepairs.WithLabelValues("up").Inc()
+	}
+
+	if err := m.ensureAddr(link, podCIDR); err != nil {
+		return err
+	}
+	return m.ensureHairpin(link)
+}
+
+// ensureAddr assigns the gateway of podCIDR to the bridge, the same as the
+// bridge plugin with isGateway, and removes the other addresses inside podCIDR
+// or the previous pod cidr. Addresses outside both are left alone, since they
+// may be assigned by others.
+func (m *Manager) ensureAddr(link netlink.Link, podCIDR *net.IPNet) error {
+	gw := &net.IPNet{IP: ip.NextIP(podCIDR.IP.Mask(podCIDR.Mask)), Mask: podCIDR.Mask}
+	family := netlink.FAMILY_V4
+	if gw.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of %s: %v", m.name, err)
+	}
+	oldPodCIDR := m.getOldPodCIDR()
+	var found bool
+	for i := range addrs {
+		addr := &addrs[i]
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if addr.IPNet.String() == gw.String() {
+			found = true
+			continue
+		}
+		if !podCIDR.Contains(addr.IP) && (oldPodCIDR == nil || !oldPodCIDR.Contains(addr.IP)) {
+			continue
+		}
+		log.Infof("bridge: remove stale pod cidr address %s from %s", addr.IPNet, m.name)
+		if err := netlink.AddrDel(link, addr); err != nil {
+			log.Errorf("bridge: failed to remove address %s from %s: %v", addr.IPNet, m.name, err)
+			continue
+		}
+		bridgeRepairs.WithLabelValues("address_removed").Inc()
+	}
+	if found {
+		return nil
+	}
+
+	log.Infof("bridge: add gateway address %s to %s", gw, m.name)
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: gw}); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add address %s to %s: %v", gw, m.name, err)
+	}
+	bridgeRepairs.WithLabelValues("address_added").Inc()
+	return nil
+}
@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+// ensureHairpin sets or clears hairpin mode on every port of the bridge, so
+// that ports created before the hairpin mode changed follow the new mode too.
+func (m *Manager) ensureHairpin(bridge netlink.Link) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Attrs().MasterIndex != bridge.Attrs().Index {
+			continue
+		}
+		protinfo, err := netlink.LinkGetProtinfo(link)
+		if err != nil {
+			// the port may have been removed along with its pod
+			log.V(4).Infof("bridge: failed to get port info of %s: %v", link.Attrs().Name, err)
+			continue
+		}
+		if protinfo.Hairpin == m.hairpin {
+			continue
+		}
+		log.Infof("bridge: set hairpin of port %s to %t", link.Attrs().Name, m.hairpin)
+		if err := netlink.LinkSetHairpin(link, m.hairpin); err != nil {
+			log.Errorf("bridge: failed to set hairpin of port %s: %v", link.Attrs().Name, err)
+			continue
+		}
+		bridgeRepairs.WithLabelValues("hairpin").Inc()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/qyzhaoxun/tke-bridge-agent/bgp"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// annotationBGPASN and annotationBGPPeers override --bgp-asn and
+	// --bgp-peers for a node, e.g. to peer with its top of rack router.
+	annotationBGPASN   = "tke.cloud.tencent.com/bgp-asn"
+	annotationBGPPeers = "tke.cloud.tencent.com/bgp-peers"
+)
+
+// bgpNeighbors parses neighbors of the form asn@host[:port].
+func bgpNeighbors(peers []string) ([]bgp.Neighbor, error) {
+	var neighbors []bgp.Neighbor
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		neighbor, err := bgp.ParseNeighbor(peer)
+		if err != nil {
+			return nil, err
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, nil
+}
+
+// bgpConfig returns the config of the bgp speaker of node, from its
+// annotations if present, otherwise from flags. The router id defaults to
+// the internal ip of node.
+func (o *Options) bgpConfig(node *v1.Node) (bgp.Config, error) {
+	config := bgp.Config{ASN: o.BGPASN, HoldTime: o.BGPHoldTime}
+	if s, ok := node.Annotations[annotationBGPASN]; ok {
+		asn, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return bgp.Config{}, errors.Errorf("invalid annotation %s %q", annotationBGPASN, s)
+		}
+		config.ASN = uint32(asn)
+	}
+	peers := o.BGPPeers
+	if s, ok := node.Annotations[annotationBGPPeers]; ok {
+		peers = strings.Split(s, ",")
+	}
+	neighbors, err := bgpNeighbors(peers)
+	if err != nil {
+		return bgp.Config{}, errors.Wrap(err, annotationBGPPeers)
+	}
+	config.Neighbors = neighbors
+
+	if o.BGPRouterID != "" {
+		config.RouterID = net.ParseIP(o.BGPRouterID)
+	} else {
+		for _, addr := range node.Status.Addresses {
+			if ip := net.ParseIP(addr.Address); addr.Type == v1.NodeInternalIP && ip.To4() != nil {
+				config.RouterID = ip
+				break
+			}
+		}
+	}
+	if config.ASN == 0 || config.RouterID.To4() == nil {
+		return bgp.Config{}, errors.Errorf("no bgp asn or ipv4 router id of node %s", node.Name)
+	}
+	return config, nil
+}
+
+// syncBGP advertises the pod cidr of node to the bgp neighbors of node, or
+// withdraws it if node has no pod cidr. Sessions are closed if the config of
+// node is invalid.
+func syncBGP(speaker *bgp.Speaker, o *Options, node *v1.Node) {
+	config, err := o.bgpConfig(node)
+	if err != nil {
+		log.Errorf("Failed to config bgp, close sessions: %v", err)
+	}
+	speaker.SetConfig(config)
+
+	var prefixes []*net.IPNet
+	if node.Spec.PodCIDR != "" {
+		_, cidr, err := net.ParseCIDR(node.Spec.PodCIDR)
+		if err != nil {
+			log.Errorf("Failed to parse cidr %s : %v", node.Spec.PodCIDR, err)
+		} else if cidr.IP.To4() != nil {
+			prefixes = append(prefixes, cidr)
+		}
+	}
+	speaker.SetPrefixes(prefixes)
+}
+
+// bgpChanged tells whether the pod cidr, the bgp annotations or the addresses
+// of a node changed, e.g. the pod cidr is removed and must be withdrawn.
+func bgpChanged(oldNode, newNode *v1.Node) bool {
+	return oldNode.Spec.PodCIDR != newNode.Spec.PodCIDR ||
+		oldNode.Annotations[annotationBGPASN] != newNode.Annotations[annotationBGPASN] ||
+		oldNode.Annotations[annotationBGPPeers] != newNode.Annotations[annotationBGPPeers] ||
+		!reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses)
+}
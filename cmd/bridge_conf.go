@@ -10,12 +10,18 @@ import (
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	log "github.com/golang/glog"
+	"github.com/qyzhaoxun/tke-bridge-agent/routing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	defaultCniConfDir = "/host/etc/cni/net.d"
+	defaultCniBinDir  = "/host/opt/cni/bin"
 	pluginName        = "tke-bridge"
 	bridgeName        = "cbr0"
+	defaultBridgeMTU  = 1460
 )
 
 const NetConfTemplateBegin = `{
@@ -86,31 +92,8 @@ func generateBridgeConf(cidr *net.IPNet, mtu int, hairpinMode string, confDir st
 	ipn := cidr.IP.Mask(cidr.Mask)
 	gw := ip.NextIP(ipn).String()
 
-	var iMtu int
-	if mtu == 0 {
-		if link, err := findMinMTU(); err == nil {
-			iMtu = link.MTU
-			log.Infof("Using interface %s MTU %d as bridge MTU", link.Name, link.MTU)
-		} else {
-			iMtu = 1460
-			log.Warningf("Failed to find default bridge MTU, using %d: %v", iMtu, err)
-		}
-	} else {
-		iMtu = mtu
-	}
-
-	var bHairpinMode, bPromiscMode bool
-	switch hairpinMode {
-	case HairpinVeth:
-		bHairpinMode = true
-		bPromiscMode = false
-	case PromiscuousBridge:
-		bHairpinMode = false
-		bPromiscMode = true
-	default:
-		bHairpinMode = false
-		bPromiscMode = false
-	}
+	iMtu := bridgeMTU(mtu)
+	bHairpinMode, bPromiscMode := hairpinFlags(hairpinMode)
 
 	var confList []string
 	bridgeConf := fmt.Sprintf(BridgeConf, bridgeName, iMtu, bHairpinMode, bPromiscMode, subnet, gw)
@@ -122,8 +105,7 @@ func generateBridgeConf(cidr *net.IPNet, mtu int, hairpinMode string, confDir st
 		confList = append(confList, PortMappingConf)
 	}
 	cniConf := NetConfTemplateBegin + strings.Join(confList, ",") + NetConfTemplateEnd
-	fileName := fmt.Sprintf("20-%s.conflist", pluginName)
-	log.Infof("Generate bridge conf %s : %s", fileName, cniConf)
+	log.Infof("Generate bridge conf %s : %s", bridgeConfPath(confDir), cniConf)
 
 	if _, err := os.Stat(confDir); os.IsNotExist(err) {
 		if err1 := os.Mkdir(confDir, 0755); err1 != nil {
@@ -131,7 +113,55 @@ func generateBridgeConf(cidr *net.IPNet, mtu int, hairpinMode string, confDir st
 		}
 	}
 
-	return ioutil.WriteFile(path.Join(confDir, fileName), []byte(cniConf), 0644)
+	return ioutil.WriteFile(bridgeConfPath(confDir), []byte(cniConf), 0644)
+}
+
+// bridgeMTU returns mtu, or the minimal mtu of the up interfaces if mtu is 0.
+func bridgeMTU(mtu int) int {
+	if mtu != 0 {
+		return mtu
+	}
+	link, err := findMinMTU()
+	if err != nil {
+		log.Warningf("Failed to find default bridge MTU, using %d: %v", defaultBridgeMTU, err)
+		return defaultBridgeMTU
+	}
+	log.Infof("Using interface %s MTU %d as bridge MTU", link.Name, link.MTU)
+	return link.MTU
+}
+
+// vxlanBridgeMTU returns the mtu of the vxlan device over the interface of
+// the node ip, so that pod traffic fits after encapsulation.
+func vxlanBridgeMTU(client kubernetes.Interface, nodeName string) int {
+	node, err := client.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		log.Warningf("Failed to get node %s, using %d as bridge MTU: %v", nodeName, defaultBridgeMTU-routing.VXLANOverhead, err)
+		return defaultBridgeMTU - routing.VXLANOverhead
+	}
+	mtu, err := routing.VXLANMTU(node)
+	if err != nil {
+		log.Warningf("Failed to find the vxlan MTU, using %d as bridge MTU: %v", defaultBridgeMTU-routing.VXLANOverhead, err)
+		return defaultBridgeMTU - routing.VXLANOverhead
+	}
+	log.Infof("Using vxlan MTU %d as bridge MTU", mtu)
+	return mtu
+}
+
+// hairpinFlags returns the hairpinMode and promiscMode of the bridge plugin
+// for hairpinMode.
+func hairpinFlags(hairpinMode string) (hairpin bool, promisc bool) {
+	switch hairpinMode {
+	case HairpinVeth:
+		return true, false
+	case PromiscuousBridge:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func bridgeConfPath(confDir string) string {
+	return path.Join(confDir, fmt.Sprintf("20-%s.conflist", pluginName))
 }
 
 func findMinMTU() (*net.Interface, error) {
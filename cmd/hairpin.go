@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// HairpinAuto picks the hairpin mode from the kubelet and kube-proxy
+	// configuration.
+	HairpinAuto = "auto"
+
+	defaultKubeletConfig           = "/var/lib/kubelet/config.yaml"
+	defaultKubeProxyMetricsAddress = "127.0.0.1:10249"
+
+	kubeProxyConfigMapNamespace = "kube-system"
+	kubeProxyConfigMapName      = "kube-proxy"
+	kubeProxyConfigMapKey       = "config.conf"
+
+	kubeProxyTimeout = 5 * time.Second
+)
+
+// kubeletHairpinMode reads hairpinMode from the kubelet config file, empty if
+// the file does not set it.
+func kubeletHairpinMode(configPath string) (string, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		HairpinMode string `json:"hairpinMode"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", errors.Wrapf(err, "failed to parse %s", configPath)
+	}
+	return config.HairpinMode, nil
+}
+
+// kubeProxyMode asks kube-proxy on this node for its proxy mode, and falls
+// back to the mode in the kube-proxy ConfigMap.
+func kubeProxyMode(metricsAddress string, client kubernetes.Interface) (string, error) {
+	httpClient := &http.Client{Timeout: kubeProxyTimeout}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/proxyMode", metricsAddress))
+	if err == nil {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return strings.TrimSpace(string(body)), nil
+		}
+	}
+	log.V(4).Infof("failed to get proxy mode from kube-proxy at %s: %v", metricsAddress, err)
+
+	cm, err := client.CoreV1().ConfigMaps(kubeProxyConfigMapNamespace).Get(kubeProxyConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get configmap %s/%s", kubeProxyConfigMapNamespace, kubeProxyConfigMapName)
+	}
+	var config struct {
+		Mode string `json:"mode"`
+	}
+	if err := yaml.Unmarshal([]byte(cm.Data[kubeProxyConfigMapKey]), &config); err != nil {
+		return "", errors.Wrapf(err, "failed to parse %s of configmap %s/%s", kubeProxyConfigMapKey,
+			kubeProxyConfigMapNamespace, kubeProxyConfigMapName)
+	}
+	if config.Mode == "" {
+		// the default mode of kube-proxy on linux
+		return "iptables", nil
+	}
+	return config.Mode, nil
+}
+
+// needsHairpin tells whether kube-proxy in proxyMode drops hairpin packets of
+// bridge pods unless the bridge or its ports handle them.
+func needsHairpin(proxyMode string) bool {
+	switch proxyMode {
+	case "iptables", "ipvs", "userspace":
+		return true
+	default:
+		return false
+	}
+}
+
+// resolveHairpinMode picks the hairpin mode for "auto" from the kubelet and
+// kube-proxy configuration. Explicit modes are returned as is, without
+// reading the kubelet config or asking kube-proxy and the api server.
+func resolveHairpinMode(o *Options, client kubernetes.Interface) string {
+	if o.HairpinMode != HairpinAuto {
+		return o.HairpinMode
+	}
+
+	kubeletConfig := path.Join("/", o.HostRoot, o.KubeletConfig)
+	kubeletMode, err := kubeletHairpinMode(kubeletConfig)
+	if err != nil {
+		log.Warningf("Failed to get hairpin mode of kubelet from %s: %v", kubeletConfig, err)
+	}
+	proxyMode, err := kubeProxyMode(o.KubeProxyMetricsAddress, client)
+	if err != nil {
+		log.Warningf("Failed to get proxy mode of kube-proxy: %v", err)
+	}
+	log.Infof("Found kubelet hairpin mode %q, kube-proxy mode %q", kubeletMode, proxyMode)
+
+	mode := kubeletMode
+	switch {
+	case mode == HairpinNone && needsHairpin(proxyMode):
+		log.Warningf("Kubelet hairpin mode %s drops hairpin packets with kube-proxy in %s mode, use %s",
+			mode, proxyMode, PromiscuousBridge)
+		mode = PromiscuousBridge
+	case mode != HairpinVeth && mode != PromiscuousBridge && mode != HairpinNone:
+		// the default of kubelet
+		mode = PromiscuousBridge
+	}
+	log.Infof("Use hairpin mode %s", mode)
+	return mode
+}
@@ -3,12 +3,20 @@ package main
 import (
 	goflag "flag"
 	"fmt"
+	"github.com/qyzhaoxun/tke-bridge-agent/bgp"
+	"github.com/qyzhaoxun/tke-bridge-agent/bridge"
+	"github.com/qyzhaoxun/tke-bridge-agent/cri"
+	"github.com/qyzhaoxun/tke-bridge-agent/events"
+	"github.com/qyzhaoxun/tke-bridge-agent/firewall"
+	"github.com/qyzhaoxun/tke-bridge-agent/iprule"
+	"github.com/qyzhaoxun/tke-bridge-agent/kmod"
 	"github.com/qyzhaoxun/tke-bridge-agent/reconciler"
-	"io/ioutil"
+	"github.com/qyzhaoxun/tke-bridge-agent/routing"
+	"github.com/qyzhaoxun/tke-bridge-agent/sysctl"
 	"math/rand"
 	"net"
 	"os"
-	"os/exec"
+	"path"
 	"time"
 
 	log "github.com/golang/glog"
@@ -25,7 +33,8 @@ import (
 )
 
 const (
-	ObjectNameField = "metadata.name"
+	ObjectNameField  = "metadata.name"
+	PodNodeNameField = "spec.nodeName"
 )
 
 func main() {
@@ -42,10 +51,29 @@ func main() {
 				log.Fatalf("Failed to config agent options, error %v", err)
 			}
 
+			if o.Cleanup {
+				if err := cleanup(o); err != nil {
+					log.Fatalf("Failed to clean up, error %v", err)
+				}
+				log.Infof("Cleaned up")
+				return
+			}
+
 			log.Infof("Start tke cni bridge")
-			err = ensureBridgeNFCallIptables()
-			if err != nil {
-				log.Fatal(err)
+			kernelChecker := kmod.NewChecker(o.HostRoot)
+			kernelReport := kernelChecker.Check(kmod.Modules(o.PortMapping, o.Bandwidth))
+			if !kernelReport.Ready {
+				// without --require-kernel-modules missing modules are only
+				// reported, here and via /healthz/kernel
+				if o.RequireKernelModules {
+					log.Fatalf("Kernel modules %v required by bridge pods are not available",
+						kernelReport.Names(true, kmod.StateMissing))
+				}
+				log.Warningf("Kernel modules %v required by bridge pods are not available, bridge pods may not work",
+					kernelReport.Names(true, kmod.StateMissing))
+			}
+			if missing := kernelReport.Names(false, kmod.StateMissing, kmod.StateUnknown); len(missing) > 0 {
+				log.Warningf("Kernel modules %v are not found, some features may not work", missing)
 			}
 
 			nodeName := os.Getenv("MY_NODE_NAME")
@@ -63,6 +91,132 @@ func main() {
 				log.Fatalf("Failed to new kube client, error %v", err)
 			}
 
+			o.HairpinMode = resolveHairpinMode(o, client)
+			if o.MTU == 0 && o.RoutingMode == routing.ModeVXLAN {
+				o.MTU = vxlanBridgeMTU(client, nodeName)
+			}
+
+			// the runtime may be down for a while, e.g. being upgraded, which
+			// must not stop maintaining the bridge conf, cbr0 and the rules
+			criClient := cri.New(o.RuntimeEndpoints, o.HostRoot)
+
+			stopChan := signals.SetupSignalHandler()
+			recorder := events.NewRecorder(client, nodeName)
+
+			sysctls, err := o.sysctls()
+			if err != nil {
+				log.Fatal(err)
+			}
+			sysctlManager := sysctl.New(sysctls, o.SysctlCheckInterval, nodeName, recorder)
+			if err := sysctlManager.Ensure(); err != nil {
+				log.Fatal(err)
+			}
+			if o.SysctlCheckInterval > 0 {
+				go sysctlManager.Run(stopChan)
+			}
+
+			reconcilerConfig := reconciler.Config{
+				CRIClient:           criClient,
+				AllocateInfoPath:    o.AllocateInfoPath,
+				CniConfFile:         bridgeConfPath(o.CniConfDir),
+				CniBinDir:           o.CniBinDir,
+				CNIResultsDir:       path.Join("/", o.HostRoot, o.CNIResultsDir),
+				CheckInterval:       o.ReconcileInterval,
+				SandboxPollInterval: o.SandboxPollInterval,
+				Audit:               o.IPAudit,
+				BridgeName:          bridgeName,
+				VethGCGracePeriod:   o.VethGCGracePeriod,
+				FlushCNIReleasedIPs: o.FlushCNIReleasedIPs,
+				NodeName:            nodeName,
+				Recorder:            recorder,
+			}
+			if o.PodCrossCheck || o.IPAudit {
+				log.Infof("Run pod controller")
+				podFieldSelector := fields.OneTermEqualSelector(PodNodeNameField, nodeName)
+				podLW := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "pods", metav1.NamespaceAll, podFieldSelector)
+				podStore, podController := cache.NewIndexerInformer(podLW, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{}, cache.Indexers{})
+				go podController.Run(stopChan)
+				reconcilerConfig.PodStore = podStore
+				reconcilerConfig.PodsSynced = podController.HasSynced
+				reconcilerConfig.PodCrossCheck = o.PodCrossCheck
+			}
+			cniReconciler := reconciler.New(reconcilerConfig)
+			podCIDRHandlers := []func(*net.IPNet){cniReconciler.SetPodCIDR}
+
+			if o.AddRule {
+				ruleConfig, err := o.ruleConfig()
+				if err != nil {
+					log.Fatal(err)
+				}
+				ruleConfig.NodeName = nodeName
+				ruleConfig.Recorder = recorder
+				ruleManager := iprule.New(ruleConfig)
+				go ruleManager.Run(stopChan)
+				podCIDRHandlers = append(podCIDRHandlers, ruleManager.SetPodCIDR)
+			}
+
+			if o.BridgeCheckInterval > 0 {
+				hairpin, promisc := hairpinFlags(o.HairpinMode)
+				bridgeManager := bridge.New(bridge.Config{
+					Name:          bridgeName,
+					MTU:           o.MTU,
+					Promisc:       promisc,
+					Hairpin:       hairpin,
+					CheckInterval: o.BridgeCheckInterval,
+				})
+				go bridgeManager.Run(stopChan)
+				podCIDRHandlers = append(podCIDRHandlers, bridgeManager.SetPodCIDR)
+			}
+
+			if o.FirewallCheckInterval > 0 {
+				if o.FirewallBackend == firewall.BackendNFTables {
+					if name := firewall.IPTablesForwardDrop(); name != "" {
+						log.Fatalf("FORWARD of %s drops by default, which the forward rules of %s cannot override, use --firewall-backend=%s",
+							name, firewall.BackendNFTables, name)
+					}
+				}
+				firewallManager, err := firewall.New(firewall.Config{
+					BridgeName:    bridgeName,
+					Backend:       o.FirewallBackend,
+					CheckInterval: o.FirewallCheckInterval,
+					MasqConfig:    o.flagMasqConfig(),
+				})
+				if err != nil {
+					log.Fatalf("Failed to init firewall, error %v", err)
+				}
+				if o.Masquerade && o.MasqueradeConfigMap != "" {
+					if err := watchMasqConfigMap(client, o.MasqueradeConfigMap, o, firewallManager, stopChan); err != nil {
+						log.Fatalf("Failed to watch masquerade configmap, error %v", err)
+					}
+				}
+				go firewallManager.Run(stopChan)
+				podCIDRHandlers = append(podCIDRHandlers, firewallManager.SetPodCIDR)
+			}
+
+			if o.RoutingMode != "" {
+				routingManager, err := routing.New(routing.Config{
+					Mode:          o.RoutingMode,
+					Table:         o.RoutingTable,
+					RulePriority:  o.RoutingRulePriority,
+					CheckInterval: o.RoutingCheckInterval,
+					VNI:           o.VXLANVNI,
+					VXLANPort:     o.VXLANPort,
+					Client:        client,
+					NodeName:      nodeName,
+					Recorder:      recorder,
+				})
+				if err != nil {
+					log.Fatalf("Failed to init routing, error %v", err)
+				}
+				go routingManager.Run(stopChan)
+			}
+
+			var bgpSpeaker *bgp.Speaker
+			if o.BGP {
+				bgpSpeaker = bgp.NewSpeaker()
+				go bgpSpeaker.Run(stopChan)
+			}
+
 			log.Infof("Run node controller")
 			fieldSelector := fields.OneTermEqualSelector(ObjectNameField, nodeName)
 			nodeLW := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "nodes", metav1.NamespaceAll, fieldSelector)
@@ -70,20 +224,27 @@ func main() {
 				AddFunc: func(obj interface{}) {
 					node, ok := obj.(*v1.Node)
 					if ok {
-						syncPodCidr(node.Spec.PodCIDR, o)
+						syncPodCidr(node.Spec.PodCIDR, o, podCIDRHandlers...)
+						if bgpSpeaker != nil {
+							syncBGP(bgpSpeaker, o, node)
+						}
 					}
 				},
 				UpdateFunc: func(oldObj, newObj interface{}) {
 					oldNode, ok1 := oldObj.(*v1.Node)
 					newNode, ok2 := newObj.(*v1.Node)
 					if ok1 && ok2 && oldNode.Spec.PodCIDR != newNode.Spec.PodCIDR {
-						syncPodCidr(newNode.Spec.PodCIDR, o)
+						syncPodCidr(newNode.Spec.PodCIDR, o, podCIDRHandlers...)
+					}
+					if ok1 && ok2 && bgpSpeaker != nil && bgpChanged(oldNode, newNode) {
+						syncBGP(bgpSpeaker, o, newNode)
 					}
 				},
 			}, cache.Indexers{})
 
-			stopChan := signals.SetupSignalHandler()
-			cniReconciler := reconciler.New(o.AllocateInfoPath)
+			if o.MetricsBindAddress != "" {
+				go serveHTTP(o.MetricsBindAddress, cniReconciler, criClient, kernelChecker)
+			}
 
 			go nodeController.Run(stopChan)
 			go cniReconciler.Run(stopChan)
@@ -112,7 +273,9 @@ func main() {
 	}
 }
 
-func syncPodCidr(podCidr string, o *Options) error {
+// syncPodCidr generates bridge conf for podCidr, then notifies
+// handlers of the new cidr.
+func syncPodCidr(podCidr string, o *Options, handlers ...func(*net.IPNet)) error {
 	log.Infof("Sync pod cidr %s", podCidr)
 	if podCidr == "" {
 		log.Warningf("node has no pod cidr assigned, skipped")
@@ -129,32 +292,42 @@ func syncPodCidr(podCidr string, o *Options) error {
 		return err
 	}
 
-	if o.AddRule {
-		if cidr.IP.IsLoopback() {
-			log.Warningf("loopback cidr %+v, skipping add rule", cidr)
-		} else {
-			err = ensureRule(cidr)
-			if err != nil {
-				log.Errorf("Failed to ensure rule %+v : %v", cidr, err)
-				return err
-			}
-		}
+	for _, handler := range handlers {
+		handler(cidr)
 	}
-
 	return nil
 }
 
-func ensureBridgeNFCallIptables() error {
-	// set net.bridge.bridge-nf-call-iptables=1
-	command := exec.Command("modprobe", "br-netfilter")
-	out, err := command.CombinedOutput()
-	if err != nil {
-		log.Warningf("failed to modprobe br-netfilter, error %v, output %s", err, string(out))
+// cleanup removes the state the agent installs on the node, by every
+// available firewall backend since the one in use may have changed. Routing
+// is only cleaned up with --routing-mode, as the table may be of others
+// otherwise.
+func cleanup(o *Options) error {
+	var failed []error
+	if err := iprule.New(iprule.Config{Realm: o.RuleRealm}).Cleanup(); err != nil {
+		failed = append(failed, err)
 	}
-
-	err = ioutil.WriteFile("/proc/sys/net/bridge/bridge-nf-call-iptables", []byte("1"), 0640)
-	if err != nil {
-		return fmt.Errorf("failed to set bridge-nf-call-iptables, error %v", err)
+	if o.RoutingMode != "" {
+		routingManager, err := routing.New(routing.Config{Table: o.RoutingTable})
+		if err != nil {
+			return err
+		}
+		if err := routingManager.Cleanup(); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	for _, backend := range []string{firewall.BackendIPTablesLegacy, firewall.BackendIPTablesNFT, firewall.BackendNFTables} {
+		firewallManager, err := firewall.New(firewall.Config{BridgeName: bridgeName, Backend: backend})
+		if err != nil {
+			log.V(2).Infof("Skip cleaning up by %s: %v", backend, err)
+			continue
+		}
+		if err := firewallManager.Cleanup(); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v", failed)
 	}
 	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/qyzhaoxun/tke-bridge-agent/firewall"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// flagMasqConfig returns the masquerade config from flags, nil if
+// masquerading is disabled.
+func (o *Options) flagMasqConfig() *firewall.MasqConfig {
+	if !o.Masquerade {
+		return nil
+	}
+	return &firewall.MasqConfig{
+		NonMasqueradeCIDRs: o.NonMasqueradeCIDRs,
+		MasqLinkLocal:      o.MasqLinkLocal,
+	}
+}
+
+// splitNamespacedName splits namespace/name.
+func splitNamespacedName(s string) (string, string, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid %q, expect namespace/name", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// watchMasqConfigMap keeps the masquerade config of firewallManager in sync
+// with the ConfigMap namespace/name, and falls back to the flags while the
+// ConfigMap is absent or invalid.
+func watchMasqConfigMap(client kubernetes.Interface, configMap string, o *Options, firewallManager *firewall.Manager, stopCh <-chan struct{}) error {
+	namespace, name, err := splitNamespacedName(configMap)
+	if err != nil {
+		return err
+	}
+
+	update := func(obj interface{}) {
+		cm, ok := obj.(*v1.ConfigMap)
+		if !ok {
+			return
+		}
+		config, err := firewall.ParseMasqConfig(cm.Data)
+		if err != nil {
+			log.Errorf("Invalid masquerade configmap %s, use flags: %v", configMap, err)
+			firewallManager.SetMasqConfig(o.flagMasqConfig())
+			return
+		}
+		log.Infof("Reload masquerade config from configmap %s: %+v", configMap, *config)
+		firewallManager.SetMasqConfig(config)
+	}
+
+	fieldSelector := fields.OneTermEqualSelector(ObjectNameField, name)
+	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "configmaps", namespace, fieldSelector)
+	_, controller := cache.NewInformer(lw, &v1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			update(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Infof("Masquerade configmap %s is deleted, use flags", configMap)
+			firewallManager.SetMasqConfig(o.flagMasqConfig())
+		},
+	})
+	go controller.Run(stopCh)
+	return nil
+}
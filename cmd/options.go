@@ -1,7 +1,18 @@
 package main
 
 import (
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/qyzhaoxun/tke-bridge-agent/bgp"
+	"github.com/qyzhaoxun/tke-bridge-agent/bridge"
+	"github.com/qyzhaoxun/tke-bridge-agent/firewall"
+	"github.com/qyzhaoxun/tke-bridge-agent/iprule"
+	"github.com/qyzhaoxun/tke-bridge-agent/reconciler"
+	"github.com/qyzhaoxun/tke-bridge-agent/routing"
+	"github.com/qyzhaoxun/tke-bridge-agent/sysctl"
 	"github.com/spf13/pflag"
 )
 
@@ -10,9 +21,64 @@ type Options struct {
 	HairpinMode      string
 	AddRule          bool
 	CniConfDir       string
+	CniBinDir        string
 	PortMapping      bool
 	Bandwidth        bool
 	AllocateInfoPath string
+	CNIResultsDir    string
+
+	RulePriority      int
+	RuleTable         int
+	RuleRealm         int
+	RuleCIDRs         []string
+	RuleFromPodCIDR   bool
+	RuleCheckInterval time.Duration
+	RuleCoexistENI    bool
+
+	RoutingMode          string
+	RoutingTable         int
+	RoutingRulePriority  int
+	RoutingCheckInterval time.Duration
+	VXLANVNI             int
+	VXLANPort            int
+
+	BGP         bool
+	BGPASN      uint32
+	BGPPeers    []string
+	BGPRouterID string
+	BGPHoldTime time.Duration
+
+	KubeletConfig           string
+	KubeProxyMetricsAddress string
+
+	BridgeCheckInterval time.Duration
+
+	Sysctls             []string
+	SysctlCheckInterval time.Duration
+	UplinkLooseRPFilter bool
+
+	FirewallCheckInterval time.Duration
+	FirewallBackend       string
+	Cleanup               bool
+
+	Masquerade          bool
+	NonMasqueradeCIDRs  []string
+	MasqLinkLocal       bool
+	MasqueradeConfigMap string
+
+	ReconcileInterval   time.Duration
+	SandboxPollInterval time.Duration
+	PodCrossCheck       bool
+	IPAudit             bool
+	VethGCGracePeriod   time.Duration
+	FlushCNIReleasedIPs bool
+
+	MetricsBindAddress string
+
+	RuntimeEndpoints []string
+	HostRoot         string
+
+	RequireKernelModules bool
 }
 
 func NewOptions() *Options {
@@ -21,20 +87,118 @@ func NewOptions() *Options {
 		HairpinMode:      "promiscuous-bridge",
 		AddRule:          true,
 		CniConfDir:       defaultCniConfDir,
+		CniBinDir:        defaultCniBinDir,
 		PortMapping:      true,
 		Bandwidth:        false,
 		AllocateInfoPath: "",
+		CNIResultsDir:    reconciler.DefaultCNIResultsDir,
+
+		RulePriority:      iprule.DefaultPriority,
+		RuleTable:         iprule.DefaultTable,
+		RuleRealm:         iprule.DefaultRealm,
+		RuleCIDRs:         nil,
+		RuleFromPodCIDR:   false,
+		RuleCheckInterval: iprule.DefaultCheckInterval,
+		RuleCoexistENI:    false,
+
+		RoutingMode:          "",
+		RoutingTable:         routing.DefaultTable,
+		RoutingRulePriority:  routing.DefaultRulePriority,
+		RoutingCheckInterval: routing.DefaultCheckInterval,
+		VXLANVNI:             routing.DefaultVNI,
+		VXLANPort:            routing.DefaultVXLANPort,
+
+		BGP:         false,
+		BGPASN:      0,
+		BGPPeers:    nil,
+		BGPRouterID: "",
+		BGPHoldTime: bgp.DefaultHoldTime,
+
+		KubeletConfig:           defaultKubeletConfig,
+		KubeProxyMetricsAddress: defaultKubeProxyMetricsAddress,
+
+		BridgeCheckInterval: bridge.DefaultCheckInterval,
+
+		Sysctls:             nil,
+		SysctlCheckInterval: sysctl.DefaultCheckInterval,
+		UplinkLooseRPFilter: false,
+
+		FirewallCheckInterval: firewall.DefaultCheckInterval,
+		FirewallBackend:       firewall.BackendAuto,
+		Cleanup:               false,
+
+		Masquerade:          false,
+		NonMasqueradeCIDRs:  nil,
+		MasqLinkLocal:       false,
+		MasqueradeConfigMap: "",
+
+		ReconcileInterval:   reconciler.DefaultCheckInterval,
+		SandboxPollInterval: reconciler.DefaultSandboxPollInterval,
+		PodCrossCheck:       false,
+		IPAudit:             false,
+		VethGCGracePeriod:   reconciler.DefaultVethGCGracePeriod,
+		FlushCNIReleasedIPs: false,
+
+		MetricsBindAddress: defaultMetricsBindAddress,
+
+		RuntimeEndpoints: nil,
+		HostRoot:         "",
+
+		RequireKernelModules: false,
 	}
 }
 
 func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&o.MTU, "mtu", o.MTU, "interface mtu")
-	fs.StringVar(&o.HairpinMode, "hairpin-mode", o.HairpinMode, `--hairpin-mode string How should the agent setup hairpin NAT. This allows endpoints of a Service to loadbalance back to themselves if they should try to access their own Service. Valid values are "promiscuous-bridge", "hairpin-veth" and "none".`)
+	fs.StringVar(&o.HairpinMode, "hairpin-mode", o.HairpinMode, `--hairpin-mode string How should the agent setup hairpin NAT. This allows endpoints of a Service to loadbalance back to themselves if they should try to access their own Service. Valid values are "promiscuous-bridge", "hairpin-veth", "none" and "auto", which follows the kubelet and kube-proxy configuration.`)
 	fs.BoolVar(&o.AddRule, "add-rule", o.AddRule, `--add-rule bool whether add rule or not`)
+	fs.IntVar(&o.RulePriority, "rule-priority", o.RulePriority, "--rule-priority int preference of the policy routing rules")
+	fs.IntVar(&o.RuleTable, "rule-table", o.RuleTable, "--rule-table int route table the policy routing rules look up, 254 for main")
+	fs.IntVar(&o.RuleRealm, "rule-realm", o.RuleRealm, "--rule-realm int realm tagging the policy routing rules owned by the agent, only rules of the realm are deleted when no longer desired")
+	fs.StringSliceVar(&o.RuleCIDRs, "rule-cidrs", o.RuleCIDRs, "--rule-cidrs strings destinations routed by the policy routing rules besides the pod cidr, e.g. the service cidr")
+	fs.BoolVar(&o.RuleFromPodCIDR, "rule-from-pod-cidr", o.RuleFromPodCIDR, "--rule-from-pod-cidr bool whether add a policy routing rule of traffic from the pod cidr or not")
+	fs.DurationVar(&o.RuleCheckInterval, "rule-check-interval", o.RuleCheckInterval, "--rule-check-interval duration interval of verifying the policy routing rules besides on netlink notifications")
+	fs.BoolVar(&o.RuleCoexistENI, "rule-coexist-eni", o.RuleCoexistENI, "--rule-coexist-eni bool whether place the policy routing rules ahead of the rules of tke-route-eni found on the node, and report conflicts with them, or not")
+	fs.StringVar(&o.RoutingMode, "routing-mode", o.RoutingMode, `--routing-mode string how the agent routes pod cidrs of other nodes, "host-gw" through their node ips on the same l2 segment, "vxlan" through a vxlan device, or empty to leave them to the vpc`)
+	fs.IntVar(&o.RoutingTable, "routing-table", o.RoutingTable, "--routing-table int route table owned by the agent holding routes to pod cidrs of other nodes")
+	fs.IntVar(&o.RoutingRulePriority, "routing-rule-priority", o.RoutingRulePriority, "--routing-rule-priority int preference of the policy routing rule looking up the routing table")
+	fs.DurationVar(&o.RoutingCheckInterval, "routing-check-interval", o.RoutingCheckInterval, "--routing-check-interval duration interval of verifying routes to pod cidrs of other nodes besides on node and route changes")
+	fs.IntVar(&o.VXLANVNI, "vxlan-vni", o.VXLANVNI, "--vxlan-vni int vni of the vxlan device in vxlan routing mode")
+	fs.IntVar(&o.VXLANPort, "vxlan-port", o.VXLANPort, "--vxlan-port int udp port of the vxlan device in vxlan routing mode")
+	fs.BoolVar(&o.BGP, "bgp", o.BGP, "--bgp bool whether advertise the pod cidr of the node to bgp peers or not")
+	fs.Uint32Var(&o.BGPASN, "bgp-asn", o.BGPASN, "--bgp-asn uint32 as number of the node, overridden by the node annotation "+annotationBGPASN)
+	fs.StringSliceVar(&o.BGPPeers, "bgp-peers", o.BGPPeers, "--bgp-peers strings bgp peers of the form asn@ip[:port], overridden by the comma separated node annotation "+annotationBGPPeers)
+	fs.StringVar(&o.BGPRouterID, "bgp-router-id", o.BGPRouterID, "--bgp-router-id string bgp identifier and next hop of the pod cidr, defaults to the internal ip of the node")
+	fs.DurationVar(&o.BGPHoldTime, "bgp-hold-time", o.BGPHoldTime, "--bgp-hold-time duration hold time proposed to bgp peers")
 	fs.StringVar(&o.CniConfDir, "cni-conf-dir", o.CniConfDir, `--cni-conf-dir string where tke-bridge.conf located`)
+	fs.StringVar(&o.CniBinDir, "cni-bin-dir", o.CniBinDir, `--cni-bin-dir string where cni plugins used to release leaked ips located`)
 	fs.BoolVar(&o.PortMapping, "port-mapping", o.PortMapping, `--port-mapping bool whether support port-mapping or not`)
 	fs.BoolVar(&o.Bandwidth, "bandwidth", o.Bandwidth, `--bandwidth bool whether support bandwidth or not`)
 	fs.StringVar(&o.AllocateInfoPath, "allocateInfoPath", "", "--allocateInfoPath string where the ip allocate info located")
+	fs.StringVar(&o.CNIResultsDir, "cni-results-dir", o.CNIResultsDir, "--cni-results-dir string libcni result cache on the host, whose results are passed to DEL when releasing leaked ips")
+	fs.StringVar(&o.KubeletConfig, "kubelet-config", o.KubeletConfig, "--kubelet-config string kubelet config file on the host, read for hairpinMode with --hairpin-mode=auto")
+	fs.StringVar(&o.KubeProxyMetricsAddress, "kube-proxy-metrics-address", o.KubeProxyMetricsAddress, "--kube-proxy-metrics-address string address of kube-proxy serving /proxyMode on this node")
+	fs.DurationVar(&o.BridgeCheckInterval, "bridge-check-interval", o.BridgeCheckInterval, "--bridge-check-interval duration interval of converging cbr0 besides on netlink notifications, 0 to leave cbr0 to the bridge plugin")
+	fs.StringSliceVar(&o.Sysctls, "sysctl", o.Sysctls, "--sysctl strings sysctls required besides the defaults, as name=value, or name>=value for a minimum, overriding defaults of the same name")
+	fs.DurationVar(&o.SysctlCheckInterval, "sysctl-check-interval", o.SysctlCheckInterval, "--sysctl-check-interval duration interval of verifying required sysctls and re-applying changed ones, 0 to apply them only at startup")
+	fs.BoolVar(&o.UplinkLooseRPFilter, "uplink-loose-rp-filter", o.UplinkLooseRPFilter, "--uplink-loose-rp-filter bool whether set rp_filter of the default route interface to 2 (loose) or not")
+	fs.DurationVar(&o.FirewallCheckInterval, "firewall-check-interval", o.FirewallCheckInterval, "--firewall-check-interval duration interval of verifying the iptables chains owned by the agent, 0 to not install them")
+	fs.StringVar(&o.FirewallBackend, "firewall-backend", o.FirewallBackend, `--firewall-backend string how the agent programs packet filtering rules, "iptables-legacy", "iptables-nft", "nftables", or "auto" to follow kube-proxy, detected again until kube-proxy rules show up. "nftables" is rejected if FORWARD of iptables drops by default, which its base chains cannot override`)
+	fs.BoolVar(&o.Cleanup, "cleanup", o.Cleanup, "--cleanup bool remove the policy routing rules and iptables chains owned by the agent and exit, e.g. on uninstall")
+	fs.BoolVar(&o.Masquerade, "masquerade", o.Masquerade, "--masquerade bool whether masquerade pod traffic to destinations other than the pod cidr and non masquerade cidrs or not")
+	fs.StringSliceVar(&o.NonMasqueradeCIDRs, "non-masquerade-cidrs", o.NonMasqueradeCIDRs, "--non-masquerade-cidrs strings destinations reached with pod ips when masquerading, e.g. the cluster cidr and the vpc cidr")
+	fs.BoolVar(&o.MasqLinkLocal, "masq-link-local", o.MasqLinkLocal, "--masq-link-local bool whether masquerade pod traffic to 169.254.0.0/16 or not")
+	fs.StringVar(&o.MasqueradeConfigMap, "masquerade-configmap", o.MasqueradeConfigMap, "--masquerade-configmap string namespace/name of a ConfigMap in the ip-masq-agent format overriding the non masquerade flags, reloaded on changes")
+	fs.DurationVar(&o.ReconcileInterval, "reconcile-interval", o.ReconcileInterval, "--reconcile-interval duration interval of checking leaked ips in the ipam store")
+	fs.DurationVar(&o.SandboxPollInterval, "sandbox-poll-interval", o.SandboxPollInterval, "--sandbox-poll-interval duration interval of polling ready sandboxes to release ips of removed ones immediately, 0 to disable")
+	fs.BoolVar(&o.PodCrossCheck, "pod-crosscheck", o.PodCrossCheck, "--pod-crosscheck bool whether cross-check leaked ips with pods of this node from kube api or not")
+	fs.BoolVar(&o.IPAudit, "ip-audit", o.IPAudit, "--ip-audit bool whether audit pod ips of host-local, CRI and kube api before every reconciliation or not")
+	fs.DurationVar(&o.VethGCGracePeriod, "veth-gc-grace-period", o.VethGCGracePeriod, "--veth-gc-grace-period duration how long a veth on the bridge must stay orphaned before being removed, 0 to disable")
+	fs.BoolVar(&o.FlushCNIReleasedIPs, "flush-cni-released-ips", o.FlushCNIReleasedIPs, "--flush-cni-released-ips bool whether flush conntrack and neighbor entries of ips released by cni DEL, detected on every sandbox poll, or not")
+	fs.StringVar(&o.MetricsBindAddress, "metrics-bind-address", o.MetricsBindAddress, "--metrics-bind-address string address serving /metrics, /audit and /healthz/cri, empty to disable")
+	fs.StringSliceVar(&o.RuntimeEndpoints, "runtime-endpoint", o.RuntimeEndpoints, "--runtime-endpoint strings candidate CRI endpoints tried in order, e.g. unix:///run/containerd/containerd.sock, empty to probe containerd, CRI-O and cri-dockerd default sockets")
+	fs.StringVar(&o.HostRoot, "host-root", o.HostRoot, "--host-root string prefix of host paths in the agent, used when probing default runtime sockets, reading kubelet config and the libcni result cache, and loading kernel modules")
+	fs.BoolVar(&o.RequireKernelModules, "require-kernel-modules", o.RequireKernelModules, "--require-kernel-modules bool whether exit if bridge, veth or br_netfilter is not available or not, see /healthz/kernel otherwise")
 	return
 }
 
@@ -42,8 +206,95 @@ func (o *Options) Validate() error {
 	if o.CniConfDir == "" {
 		return errors.New("cni-conf-dir cannot be empty")
 	}
+	if o.ReconcileInterval <= 0 {
+		return errors.New("reconcile-interval must be positive")
+	}
+	if o.VethGCGracePeriod < 0 {
+		return errors.New("veth-gc-grace-period cannot be negative")
+	}
+	if o.BridgeCheckInterval < 0 {
+		return errors.New("bridge-check-interval cannot be negative")
+	}
+	if o.FirewallCheckInterval < 0 {
+		return errors.New("firewall-check-interval cannot be negative")
+	}
+	switch o.FirewallBackend {
+	case firewall.BackendAuto, firewall.BackendIPTablesLegacy, firewall.BackendIPTablesNFT, firewall.BackendNFTables:
+	default:
+		return errors.Errorf("invalid firewall backend %s", o.FirewallBackend)
+	}
+	if o.Masquerade {
+		if o.FirewallCheckInterval <= 0 {
+			return errors.New("masquerade requires positive firewall-check-interval")
+		}
+		if err := o.flagMasqConfig().Validate(); err != nil {
+			return err
+		}
+		if o.MasqueradeConfigMap != "" {
+			if _, _, err := splitNamespacedName(o.MasqueradeConfigMap); err != nil {
+				return errors.Wrap(err, "masquerade-configmap")
+			}
+		}
+	}
+	if o.AddRule {
+		if o.RulePriority <= 0 || o.RuleTable <= 0 {
+			return errors.New("rule-priority and rule-table must be positive")
+		}
+		if o.RuleCheckInterval <= 0 {
+			return errors.New("rule-check-interval must be positive")
+		}
+		if o.RuleRealm <= 0 || o.RuleRealm > 0xffff {
+			return errors.New("rule-realm must be in [1, 65535]")
+		}
+		if _, err := o.ruleCIDRs(); err != nil {
+			return err
+		}
+	}
+	switch o.RoutingMode {
+	case "", routing.ModeHostGW, routing.ModeVXLAN:
+	default:
+		return errors.Errorf("invalid routing mode %s", o.RoutingMode)
+	}
+	if o.RoutingMode != "" {
+		if o.RoutingTable <= 0 || o.RoutingRulePriority <= 0 || o.RoutingCheckInterval <= 0 {
+			return errors.New("routing-table, routing-rule-priority and routing-check-interval must be positive")
+		}
+	}
+	if o.RoutingMode == routing.ModeVXLAN {
+		if o.VXLANVNI <= 0 || o.VXLANVNI >= 1<<24 {
+			return errors.New("vxlan-vni must be in [1, 16777215]")
+		}
+		if o.VXLANPort <= 0 || o.VXLANPort > 65535 {
+			return errors.New("vxlan-port must be in [1, 65535]")
+		}
+	}
+	if o.BGP {
+		if _, err := bgpNeighbors(o.BGPPeers); err != nil {
+			return errors.Wrap(err, "bgp-peers")
+		}
+		if ip := net.ParseIP(o.BGPRouterID); o.BGPRouterID != "" && ip.To4() == nil {
+			return errors.Errorf("invalid bgp-router-id %s, expect an ipv4 address", o.BGPRouterID)
+		}
+		if o.BGPHoldTime < 3*time.Second {
+			return errors.New("bgp-hold-time must be at least 3s")
+		}
+	}
+	if o.SysctlCheckInterval < 0 {
+		return errors.New("sysctl-check-interval cannot be negative")
+	}
+	for _, s := range o.Sysctls {
+		if _, err := sysctl.Parse(s); err != nil {
+			return err
+		}
+	}
+	if o.SandboxPollInterval < 0 {
+		return errors.New("sandbox-poll-interval cannot be negative")
+	}
+	if o.FlushCNIReleasedIPs && o.SandboxPollInterval == 0 {
+		return errors.New("flush-cni-released-ips requires positive sandbox-poll-interval")
+	}
 	switch o.HairpinMode {
-	case "promiscuous-bridge", "hairpin-veth", "none":
+	case PromiscuousBridge, HairpinVeth, HairpinNone, HairpinAuto:
 		return nil
 	default:
 		return errors.Errorf("invalid hairpin mode %s", o.HairpinMode)
@@ -54,5 +305,64 @@ func (o *Options) Config() error {
 	if err := o.Validate(); err != nil {
 		return err
 	}
+	// resolve the mtu once, so that the conflist and cbr0 always agree. In
+	// vxlan mode it depends on the node ip, see vxlanBridgeMTU.
+	if o.MTU != 0 || o.RoutingMode != routing.ModeVXLAN {
+		o.MTU = bridgeMTU(o.MTU)
+	}
 	return nil
 }
+
+// sysctls returns the default sysctls overridden by --sysctl.
+func (o *Options) sysctls() ([]sysctl.Sysctl, error) {
+	var uplink string
+	if o.UplinkLooseRPFilter {
+		var err error
+		if uplink, err = sysctl.Uplink(); err != nil {
+			log.Warningf("Failed to find uplink interface, skip its rp_filter: %v", err)
+		}
+	}
+	var additions []sysctl.Sysctl
+	for _, str := range o.Sysctls {
+		s, err := sysctl.Parse(str)
+		if err != nil {
+			return nil, err
+		}
+		additions = append(additions, s)
+	}
+	return sysctl.Merge(sysctl.Defaults(bridgeName, uplink), additions), nil
+}
+
+// ruleConfig returns the config of the policy routing rules.
+func (o *Options) ruleConfig() (iprule.Config, error) {
+	cidrs, err := o.ruleCIDRs()
+	if err != nil {
+		return iprule.Config{}, err
+	}
+	return iprule.Config{
+		Priority:      o.RulePriority,
+		Table:         o.RuleTable,
+		Realm:         o.RuleRealm,
+		CIDRs:         cidrs,
+		FromPodCIDR:   o.RuleFromPodCIDR,
+		CheckInterval: o.RuleCheckInterval,
+		CoexistENI:    o.RuleCoexistENI,
+	}, nil
+}
+
+// ruleCIDRs parses the rule cidrs, which must be ipv4 as the realm tagging
+// the rules of the agent only exists for ipv4 rules.
+func (o *Options) ruleCIDRs() ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, str := range o.RuleCIDRs {
+		_, cidr, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, errors.Wrap(err, "rule-cidrs")
+		}
+		if cidr.IP.To4() == nil {
+			return nil, errors.Errorf("rule-cidrs: %s is not an ipv4 cidr, ipv6 rules are not supported", str)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qyzhaoxun/tke-bridge-agent/firewall"
+	"github.com/qyzhaoxun/tke-bridge-agent/routing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		set  func(o *Options)
+		err  bool
+	}{
+		{name: "defaults", set: func(o *Options) {}},
+
+		{name: "firewall backend auto", set: func(o *Options) { o.FirewallBackend = firewall.BackendAuto }},
+		{name: "firewall backend iptables-legacy", set: func(o *Options) { o.FirewallBackend = firewall.BackendIPTablesLegacy }},
+		{name: "firewall backend iptables-nft", set: func(o *Options) { o.FirewallBackend = firewall.BackendIPTablesNFT }},
+		{name: "firewall backend nftables", set: func(o *Options) { o.FirewallBackend = firewall.BackendNFTables }},
+		{name: "invalid firewall backend", set: func(o *Options) { o.FirewallBackend = "ipchains" }, err: true},
+		{name: "negative firewall check interval", set: func(o *Options) { o.FirewallCheckInterval = -time.Second }, err: true},
+
+		{name: "masquerade", set: func(o *Options) {
+			o.Masquerade = true
+			o.NonMasqueradeCIDRs = []string{"10.0.0.0/8"}
+			o.MasqueradeConfigMap = "kube-system/ip-masq-agent"
+		}},
+		{name: "masquerade without firewall", set: func(o *Options) {
+			o.Masquerade = true
+			o.FirewallCheckInterval = 0
+		}, err: true},
+		{name: "masquerade with invalid cidr", set: func(o *Options) {
+			o.Masquerade = true
+			o.NonMasqueradeCIDRs = []string{"10.0.0.0"}
+		}, err: true},
+		{name: "masquerade with invalid configmap", set: func(o *Options) {
+			o.Masquerade = true
+			o.MasqueradeConfigMap = "ip-masq-agent"
+		}, err: true},
+
+		{name: "rule cidrs", set: func(o *Options) { o.RuleCIDRs = []string{"10.0.0.0/8", "192.168.0.0/16"} }},
+		{name: "invalid rule cidr", set: func(o *Options) { o.RuleCIDRs = []string{"10.0.0.0/33"} }, err: true},
+		{name: "ipv6 rule cidr", set: func(o *Options) { o.RuleCIDRs = []string{"10.0.0.0/8", "fd00::/8"} }, err: true},
+		{name: "invalid rule cidr ignored without rule", set: func(o *Options) {
+			o.AddRule = false
+			o.RuleCIDRs = []string{"10.0.0.0/33"}
+		}},
+		{name: "rule realm out of range", set: func(o *Options) { o.RuleRealm = 1 << 16 }, err: true},
+		{name: "zero rule table", set: func(o *Options) { o.RuleTable = 0 }, err: true},
+		{name: "zero rule check interval", set: func(o *Options) { o.RuleCheckInterval = 0 }, err: true},
+
+		{name: "routing host-gw", set: func(o *Options) { o.RoutingMode = routing.ModeHostGW }},
+		{name: "routing vxlan", set: func(o *Options) { o.RoutingMode = routing.ModeVXLAN }},
+		{name: "invalid routing mode", set: func(o *Options) { o.RoutingMode = "ipip" }, err: true},
+		{name: "routing with zero table", set: func(o *Options) {
+			o.RoutingMode = routing.ModeHostGW
+			o.RoutingTable = 0
+		}, err: true},
+		{name: "vxlan vni out of range", set: func(o *Options) {
+			o.RoutingMode = routing.ModeVXLAN
+			o.VXLANVNI = 1 << 24
+		}, err: true},
+		{name: "vxlan port out of range", set: func(o *Options) {
+			o.RoutingMode = routing.ModeVXLAN
+			o.VXLANPort = 65536
+		}, err: true},
+		{name: "vxlan fields ignored without vxlan", set: func(o *Options) {
+			o.RoutingMode = routing.ModeHostGW
+			o.VXLANVNI = 0
+			o.VXLANPort = 0
+		}},
+
+		{name: "bgp", set: func(o *Options) {
+			o.BGP = true
+			o.BGPPeers = []string{"65001@10.0.0.1"}
+			o.BGPRouterID = "10.0.0.2"
+		}},
+		{name: "bgp with invalid peer", set: func(o *Options) {
+			o.BGP = true
+			o.BGPPeers = []string{"10.0.0.1"}
+		}, err: true},
+		{name: "bgp with ipv6 router id", set: func(o *Options) {
+			o.BGP = true
+			o.BGPRouterID = "fd00::1"
+		}, err: true},
+		{name: "bgp with short hold time", set: func(o *Options) {
+			o.BGP = true
+			o.BGPHoldTime = 2 * time.Second
+		}, err: true},
+
+		{name: "sysctls", set: func(o *Options) { o.Sysctls = []string{"net.core.somaxconn>=32768"} }},
+		{name: "invalid sysctl", set: func(o *Options) { o.Sysctls = []string{"net.core.somaxconn"} }, err: true},
+
+		{name: "flush released ips without polling", set: func(o *Options) {
+			o.FlushCNIReleasedIPs = true
+			o.SandboxPollInterval = 0
+		}, err: true},
+
+		{name: "hairpin promiscuous-bridge", set: func(o *Options) { o.HairpinMode = PromiscuousBridge }},
+		{name: "hairpin hairpin-veth", set: func(o *Options) { o.HairpinMode = HairpinVeth }},
+		{name: "hairpin none", set: func(o *Options) { o.HairpinMode = HairpinNone }},
+		{name: "hairpin auto", set: func(o *Options) { o.HairpinMode = HairpinAuto }},
+		{name: "invalid hairpin mode", set: func(o *Options) { o.HairpinMode = "hairpin" }, err: true},
+	} {
+		o := NewOptions()
+		c.set(o)
+		err := o.Validate()
+		if c.err && err == nil {
+			t.Errorf("%s: expect error", c.name)
+		}
+		if !c.err && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/qyzhaoxun/tke-bridge-agent/cri"
+	"github.com/qyzhaoxun/tke-bridge-agent/kmod"
+	"github.com/qyzhaoxun/tke-bridge-agent/reconciler"
+)
+
+const (
+	// defaultMetricsBindAddress is on loopback, since /audit exposes pod
+	// names and ips without authentication
+	defaultMetricsBindAddress = "127.0.0.1:10260"
+)
+
+func serveHTTP(addr string, cniReconciler *reconciler.CniReconciler, criClient cri.CRIAPIs, kernelChecker *kmod.Checker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/audit", cniReconciler.ServeAudit)
+	mux.HandleFunc("/healthz/cri", func(w http.ResponseWriter, r *http.Request) {
+		health := criClient.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	})
+	mux.HandleFunc("/healthz/kernel", func(w http.ResponseWriter, r *http.Request) {
+		report := kernelChecker.LastReport()
+		w.Header().Set("Content-Type", "application/json")
+		if report == nil || !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+
+	log.Infof("Serve metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Failed to serve metrics on %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,222 @@
+package cri
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/qyzhaoxun/tke-bridge-agent/cri/fake"
+)
+
+func newFakeRuntime(t *testing.T, apiVersions ...string) *fake.Runtime {
+	r, err := fake.NewRuntime(apiVersions...)
+	if err != nil {
+		t.Fatalf("failed to start fake runtime: %v", err)
+	}
+	r.SetSandbox(fake.Sandbox{Id: "ready", Name: "a", Namespace: "default", Uid: "uid-a", Ready: true,
+		IPs: []string{"172.16.0.2"}, NetNSPath: "/var/run/netns/cni-a"})
+	r.SetSandbox(fake.Sandbox{Id: "notready", Name: "b", Namespace: "default", Uid: "uid-b"})
+	r.SetSandbox(fake.Sandbox{Id: "host", Name: "c", Namespace: "kube-system", Uid: "uid-c", Ready: true,
+		HostNetwork: true})
+	return r
+}
+
+// allowReconnect skips the backoff after a failure.
+func allowReconnect(c *CRIClient) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	c.health.NextReconnect = time.Time{}
+}
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	for _, version := range []string{fake.APIVersionV1, fake.APIVersionV1alpha2} {
+		r := newFakeRuntime(t, version)
+		c := New([]string{r.Endpoint}, "")
+
+		if got := c.APIVersion(); got != version {
+			t.Errorf("runtime serving %s: negotiated %q", version, got)
+		}
+		if !c.Health().Healthy {
+			t.Errorf("runtime serving %s: expect healthy, got %+v", version, c.Health())
+		}
+		sandboxes, err := c.GetReadyPodSandboxes()
+		if err != nil {
+			t.Fatalf("runtime serving %s: failed to list sandboxes: %v", version, err)
+		}
+		if len(sandboxes) != 2 {
+			t.Errorf("runtime serving %s: expect 2 ready sandboxes, got %d", version, len(sandboxes))
+		}
+		for _, sandbox := range sandboxes {
+			if sandbox.State != SandboxReady {
+				t.Errorf("runtime serving %s: sandbox %s is %s", version, sandbox.ContainerId, sandbox.State)
+			}
+		}
+
+		c.Close()
+		r.Stop()
+	}
+}
+
+func TestPreferV1(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	c := New([]string{r.Endpoint}, "")
+	defer c.Close()
+
+	if got := c.APIVersion(); got != APIVersionV1 {
+		t.Errorf("expect %s, negotiated %q", APIVersionV1, got)
+	}
+}
+
+func TestSelectEndpoint(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	missing := "unix:///nonexistent/cri.sock"
+	c := New([]string{missing, r.Endpoint}, "")
+	defer c.Close()
+
+	if got := c.endpoint(); got != r.Endpoint {
+		t.Errorf("expect endpoint %s, got %q", r.Endpoint, got)
+	}
+}
+
+func TestUnreachableRuntime(t *testing.T) {
+	c := New([]string{"unix:///nonexistent/cri.sock"}, "")
+	defer c.Close()
+
+	health := c.Health()
+	if health.Healthy || health.LastError == "" || health.NextReconnect.IsZero() {
+		t.Errorf("expect unhealthy with backoff, got %+v", health)
+	}
+	if _, err := c.GetReadyPodSandboxes(); err == nil {
+		t.Errorf("expect error listing sandboxes of unreachable runtime")
+	}
+}
+
+func TestPodSandboxStatus(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	c := New([]string{r.Endpoint}, "/host")
+	defer c.Close()
+
+	info, err := c.GetPodSandboxStatus("ready")
+	if err != nil {
+		t.Fatalf("failed to get sandbox status: %v", err)
+	}
+	if len(info.IPs) != 1 || info.IPs[0] != "172.16.0.2" {
+		t.Errorf("unexpected ips %v", info.IPs)
+	}
+	if expect := path.Join("/host", "/var/run/netns/cni-a"); info.NetNSPath != expect {
+		t.Errorf("expect netns %s, got %q", expect, info.NetNSPath)
+	}
+	if info.HostNetwork {
+		t.Errorf("expect pod network")
+	}
+
+	if _, err := c.GetPodSandboxStatus("ready"); err != nil {
+		t.Fatalf("failed to get cached sandbox status: %v", err)
+	}
+	if calls := r.Calls("PodSandboxStatus"); calls != 1 {
+		t.Errorf("expect status cached after 1 call, got %d calls", calls)
+	}
+
+	host, err := c.GetPodSandboxStatus("host")
+	if err != nil {
+		t.Fatalf("failed to get sandbox status: %v", err)
+	}
+	if !host.HostNetwork {
+		t.Errorf("expect host network")
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	c := New([]string{r.Endpoint}, "")
+	defer c.Close()
+
+	// an error answer of the runtime keeps it healthy
+	r.InjectError("ListPodSandbox", status.Error(codes.Internal, "broken"))
+	if _, err := c.GetReadyPodSandboxes(); status.Code(err) != codes.Internal {
+		t.Errorf("expect Internal, got %v", err)
+	}
+	if !c.Health().Healthy {
+		t.Errorf("expect healthy after an error answer, got %+v", c.Health())
+	}
+
+	// an unavailable runtime backs off
+	r.InjectError("ListPodSandbox", status.Error(codes.Unavailable, "down"))
+	if _, err := c.GetReadyPodSandboxes(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expect Unavailable, got %v", err)
+	}
+	if c.Health().Healthy {
+		t.Errorf("expect unhealthy after Unavailable")
+	}
+	calls := r.Calls("ListPodSandbox")
+	if _, err := c.GetReadyPodSandboxes(); err == nil {
+		t.Errorf("expect error during backoff")
+	}
+	if got := r.Calls("ListPodSandbox"); got != calls {
+		t.Errorf("expect no call during backoff, got %d calls", got-calls)
+	}
+
+	r.InjectError("ListPodSandbox", nil)
+	allowReconnect(c)
+	if _, err := c.GetReadyPodSandboxes(); err != nil {
+		t.Fatalf("failed to list sandboxes after recovery: %v", err)
+	}
+	if !c.Health().Healthy {
+		t.Errorf("expect healthy after recovery, got %+v", c.Health())
+	}
+}
+
+func TestRenegotiateOnUnimplemented(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	c := New([]string{r.Endpoint}, "")
+	defer c.Close()
+
+	r.InjectError("ListPodSandbox", status.Error(codes.Unimplemented, "gone"))
+	if _, err := c.GetReadyPodSandboxes(); status.Code(err) != codes.Unimplemented {
+		t.Errorf("expect Unimplemented, got %v", err)
+	}
+	if got := c.APIVersion(); got != "" {
+		t.Errorf("expect version dropped, got %q", got)
+	}
+
+	r.InjectError("ListPodSandbox", nil)
+	if _, err := c.GetReadyPodSandboxes(); err != nil {
+		t.Fatalf("failed to list sandboxes: %v", err)
+	}
+	if got := c.APIVersion(); got != APIVersionV1 {
+		t.Errorf("expect renegotiated %s, got %q", APIVersionV1, got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	r := newFakeRuntime(t)
+	defer r.Stop()
+	c := New([]string{r.Endpoint}, "")
+	defer c.Close()
+	c.callTimeout = 100 * time.Millisecond
+
+	r.SetLatency(time.Second)
+	if _, err := c.GetReadyPodSandboxes(); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expect DeadlineExceeded, got %v", err)
+	}
+	if c.Health().Healthy {
+		t.Errorf("expect unhealthy after a hung call")
+	}
+
+	r.SetLatency(10 * time.Millisecond)
+	allowReconnect(c)
+	if _, err := c.GetReadyPodSandboxes(); err != nil {
+		t.Fatalf("failed to list sandboxes within the deadline: %v", err)
+	}
+	if !c.Health().Healthy {
+		t.Errorf("expect healthy, got %+v", c.Health())
+	}
+}
@@ -0,0 +1,170 @@
+package cri
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultCallTimeout = 10 * time.Second
+	initialBackoff     = time.Second
+	maxBackoff         = 2 * time.Minute
+)
+
+var runtimeHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "cri_healthy",
+	Help:      "Whether the container runtime answered the last CRI call.",
+})
+
+func init() {
+	prometheus.MustRegister(runtimeHealthy)
+}
+
+// Health is the state of the connection to the runtime.
+type Health struct {
+	Healthy bool `json:"healthy"`
+	// LastError is the error making the runtime unhealthy.
+	LastError string `json:"lastError,omitempty"`
+	// Since is when the runtime became healthy or unhealthy.
+	Since time.Time `json:"since"`
+	// NextReconnect is when the connection is dialed again if unhealthy.
+	NextReconnect time.Time `json:"nextReconnect,omitempty"`
+}
+
+// Health returns the state of the connection to the runtime.
+func (c *CRIClient) Health() Health {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.health
+}
+
+// Close closes the connection to the runtime.
+func (c *CRIClient) Close() {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// getConn returns the long-lived connection, dialing it if the backoff after
+// the last failure has passed. The dial may take up to defaultDialTimeout per
+// endpoint, so it runs without connLock to not block Health and Close.
+func (c *CRIClient) getConn() (*grpc.ClientConn, error) {
+	c.connLock.Lock()
+	if c.conn != nil {
+		conn := c.conn
+		c.connLock.Unlock()
+		return conn, nil
+	}
+	if now := time.Now(); now.Before(c.health.NextReconnect) {
+		err := fmt.Errorf("runtime %q unavailable, reconnect in %v: %s",
+			c.target(), c.health.NextReconnect.Sub(now), c.health.LastError)
+		c.connLock.Unlock()
+		return nil, err
+	}
+	c.connLock.Unlock()
+
+	conn, err := c.dial()
+
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if err != nil {
+		c.setUnhealthyLocked(err)
+		return nil, err
+	}
+	if c.conn != nil {
+		// a concurrent call dialed first, use its connection
+		conn.Close()
+		return c.conn, nil
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// call runs fn against the runtime service of the negotiated version with a
+// deadline, and updates the health state by its result.
+func (c *CRIClient) call(fn func(ctx context.Context, service runtimeService) error) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.callTimeout)
+	defer cancel()
+	service, err := c.runtimeService(ctx, conn)
+	if err == nil {
+		err = fn(ctx, service)
+		c.checkUnimplemented(err)
+	}
+
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if _, ok := status.FromError(err); !ok {
+		// not an answer of the runtime, e.g. it serves none of the supported
+		// CRI versions, redial after backoff
+		c.resetConnLocked(conn)
+		c.setUnhealthyLocked(err)
+		return err
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		// the runtime is gone or hung, redial after backoff
+		c.resetConnLocked(conn)
+		c.setUnhealthyLocked(err)
+	default:
+		// any other answer means the runtime is serving
+		c.setHealthyLocked()
+	}
+	return err
+}
+
+// resetConnLocked closes conn if it is still the long-lived connection.
+func (c *CRIClient) resetConnLocked(conn *grpc.ClientConn) {
+	if c.conn == conn {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *CRIClient) setHealthyLocked() {
+	c.backoff = 0
+	if !c.health.Healthy {
+		log.Infof("runtime %q is healthy", c.target())
+		c.health = Health{Healthy: true, Since: time.Now()}
+		runtimeHealthy.Set(1)
+	}
+}
+
+func (c *CRIClient) setUnhealthyLocked(err error) {
+	c.backoff *= 2
+	if c.backoff == 0 {
+		c.backoff = initialBackoff
+	}
+	if c.backoff > maxBackoff {
+		c.backoff = maxBackoff
+	}
+
+	now := time.Now()
+	since := c.health.Since
+	if c.health.Healthy || since.IsZero() {
+		since = now
+	}
+	c.health = Health{
+		Healthy:       false,
+		LastError:     err.Error(),
+		Since:         since,
+		NextReconnect: now.Add(c.backoff),
+	}
+	runtimeHealthy.Set(0)
+	log.Warningf("runtime %q is unhealthy, reconnect in %v: %v", c.target(), c.backoff, err)
+}
@@ -2,82 +2,249 @@ package cri
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
-	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	containerdPath     = "/var/run/containerd/containerd.sock"
-	condSocketPath     = "unix://" + containerdPath
-	dockerSocketPath   = "unix:///var/run/dockershim.sock"
 	defaultDialTimeout = 10 * time.Second
+
+	APIVersionV1       = "v1"
+	APIVersionV1alpha2 = "v1alpha2"
+
+	unixScheme = "unix://"
 )
 
+// defaultRuntimeSockets are probed in order when no runtime endpoint is
+// configured. /run and /var/run are both listed since /var/run is usually an
+// absolute symlink which does not resolve under a host root prefix.
+var defaultRuntimeSockets = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/var/run/crio/crio.sock",
+	"/run/cri-dockerd.sock",
+	"/var/run/cri-dockerd.sock",
+	"/var/run/dockershim.sock",
+}
+
 type CRIAPIs interface {
 	GetReadyPodSandboxes() ([]*SandboxInfo, error)
+	GetPodSandboxStatus(sandboxId string) (*SandboxInfo, error)
+	Health() Health
 }
 
-type SandboxInfo struct {
-	ContainerId string
-	PodName     string
-	NameSpace   string
+// runtimeService is the part of the CRI runtime service used by the agent,
+// implemented once per supported CRI API version.
+type runtimeService interface {
+	// Version returns the name and version of the runtime.
+	Version(ctx context.Context) (string, error)
+	ListReadyPodSandboxes(ctx context.Context) ([]*SandboxInfo, error)
+	PodSandboxStatus(ctx context.Context, sandboxId string) (*SandboxInfo, error)
+}
+
+var (
+	// apiVersions are the supported CRI API versions in order of preference
+	apiVersions     = []string{APIVersionV1, APIVersionV1alpha2}
+	runtimeServices = map[string]func(conn *grpc.ClientConn) runtimeService{
+		APIVersionV1:       newV1RuntimeService,
+		APIVersionV1alpha2: newV1alpha2RuntimeService,
+	}
+
+	apiVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "cri_api_version_info",
+		Help:      "CRI API version negotiated with the container runtime.",
+	}, []string{"version", "runtime"})
+)
+
+func init() {
+	prometheus.MustRegister(apiVersionInfo)
 }
 
 type CRIClient struct {
+	// candidates are the endpoints probed in order until one answers
+	candidates []string
+	// hostRoot prefixes the host paths reported by the runtime
+	hostRoot string
+	// callTimeout is the deadline of each CRI call
+	callTimeout time.Duration
+
+	lock       sync.Mutex
 	socketPath string
+	apiVersion string
+
+	connLock sync.Mutex
+	conn     *grpc.ClientConn
+	backoff  time.Duration
+	health   Health
+
+	statusLock sync.Mutex
+	statuses   map[string]*SandboxInfo
 }
 
-func New() *CRIClient {
-	c := &CRIClient{}
+// New returns a client of the first runtime endpoint answering a CRI Version
+// call. Endpoints are tried in order, if none is given the default sockets of
+// containerd, CRI-O and cri-dockerd under hostRoot are probed. The endpoint is
+// selected on first use, and probed again with backoff while none answers, so
+// that a runtime being down does not stop the agent.
+func New(endpoints []string, hostRoot string) *CRIClient {
+	candidates := endpoints
+	if len(candidates) == 0 {
+		for _, socket := range defaultRuntimeSockets {
+			candidates = append(candidates, path.Join("/", hostRoot, socket))
+		}
+	}
+	c := &CRIClient{candidates: candidates, hostRoot: hostRoot, callTimeout: defaultCallTimeout}
+	if err := c.checkVersion(); err != nil {
+		log.Warningf("Container runtime is not available yet, will retry: %v", err)
+	}
+	return c
+}
+
+// checkVersion negotiates the CRI API version with the runtime.
+func (c *CRIClient) checkVersion() error {
+	return c.call(func(ctx context.Context, service runtimeService) error {
+		return nil
+	})
+}
 
-	c.socketPath = dockerSocketPath
-	if info, err := os.Stat(containerdPath); err == nil && !info.IsDir() {
-		log.Infof("conatinerd socket %v exists, use it to connect to containerd", condSocketPath)
-		c.socketPath = condSocketPath
-	} else {
-		log.Infof("use docker shim socket %v to connect to docker", dockerSocketPath)
+// endpoint returns the selected runtime endpoint, empty if none answered yet.
+func (c *CRIClient) endpoint() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.socketPath
+}
+
+// target describes the runtime in logs, the candidates if no endpoint is
+// selected yet.
+func (c *CRIClient) target() string {
+	if endpoint := c.endpoint(); endpoint != "" {
+		return endpoint
+	}
+	return strings.Join(c.candidates, ",")
+}
+
+// dial connects to the selected endpoint, or selects the first candidate
+// answering a CRI Version call.
+func (c *CRIClient) dial() (*grpc.ClientConn, error) {
+	if endpoint := c.endpoint(); endpoint != "" {
+		return dialEndpoint(endpoint)
 	}
 
-	return c
+	for _, candidate := range c.candidates {
+		socket := strings.TrimPrefix(candidate, unixScheme)
+		if info, err := os.Stat(socket); err != nil || info.Mode()&os.ModeSocket == 0 {
+			log.V(4).Infof("runtime endpoint %s is not a socket, skip it", candidate)
+			continue
+		}
+		endpoint := unixScheme + socket
+		conn, err := dialEndpoint(endpoint)
+		if err != nil {
+			log.Warningf("runtime endpoint %s is not reachable: %v", endpoint, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.callTimeout)
+		_, err = c.negotiate(ctx, conn, endpoint)
+		cancel()
+		if err != nil {
+			log.Warningf("runtime endpoint %s does not answer CRI Version: %v", endpoint, err)
+			conn.Close()
+			continue
+		}
+		log.Infof("use runtime endpoint %s", endpoint)
+		c.lock.Lock()
+		c.socketPath = endpoint
+		c.lock.Unlock()
+		return conn, nil
+	}
+	return nil, fmt.Errorf("none of runtime endpoints %v answers CRI Version", c.candidates)
 }
 
-//GetReadyPodSandboxes get ready sandboxIDs
-func (c *CRIClient) GetReadyPodSandboxes() ([]*SandboxInfo, error) {
-	ctx := context.TODO()
-	log.Infof("Getting ready pod sandboxes from %q", c.socketPath)
-	conn, err := grpc.Dial(c.socketPath, grpc.WithInsecure(), grpc.WithNoProxy(),
+func dialEndpoint(endpoint string) (*grpc.ClientConn, error) {
+	return grpc.Dial(endpoint, grpc.WithInsecure(), grpc.WithNoProxy(),
 		grpc.WithBlock(), grpc.WithTimeout(defaultDialTimeout))
-	if err != nil {
-		return nil, err
+}
+
+// APIVersion returns the negotiated CRI API version, empty if not negotiated yet.
+func (c *CRIClient) APIVersion() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.apiVersion
+}
+
+// runtimeService returns the runtime service of the negotiated CRI API version
+// on conn, runtime.v1 is preferred over runtime.v1alpha2.
+func (c *CRIClient) runtimeService(ctx context.Context, conn *grpc.ClientConn) (runtimeService, error) {
+	if version := c.APIVersion(); version != "" {
+		return runtimeServices[version](conn), nil
 	}
-	defer conn.Close()
+	return c.negotiate(ctx, conn, c.endpoint())
+}
 
-	client := runtimeapi.NewRuntimeServiceClient(conn)
+// negotiate returns the runtime service of the first CRI API version served
+// by endpoint on conn.
+func (c *CRIClient) negotiate(ctx context.Context, conn *grpc.ClientConn, endpoint string) (runtimeService, error) {
+	for _, version := range apiVersions {
+		service := runtimeServices[version](conn)
+		runtimeVersion, err := service.Version(ctx)
+		if err != nil {
+			if status.Code(err) == codes.Unimplemented {
+				log.Infof("CRI %s is not served by %q, try next version", version, endpoint)
+				continue
+			}
+			return nil, err
+		}
 
-	// List all ready sandboxes from the CRI
-	sandboxes, err := client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
-		Filter: &runtimeapi.PodSandboxFilter{
-			State: &runtimeapi.PodSandboxStateValue{
-				State: runtimeapi.PodSandboxState_SANDBOX_READY,
-			},
-		},
+		log.Infof("Negotiated CRI %s with %s at %q", version, runtimeVersion, endpoint)
+		apiVersionInfo.Reset()
+		apiVersionInfo.WithLabelValues(version, runtimeVersion).Set(1)
+		c.lock.Lock()
+		c.apiVersion = version
+		c.lock.Unlock()
+		return service, nil
+	}
+	return nil, fmt.Errorf("%q serves none of CRI %v", endpoint, apiVersions)
+}
+
+// checkUnimplemented drops the negotiated version if the runtime stops
+// serving it, e.g. after being upgraded, so that the next call negotiates again.
+func (c *CRIClient) checkUnimplemented(err error) {
+	if status.Code(err) != codes.Unimplemented {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.apiVersion != "" {
+		log.Warningf("CRI %s is not served by %q any more: %v", c.apiVersion, c.socketPath, err)
+		c.apiVersion = ""
+	}
+}
+
+//GetReadyPodSandboxes get ready sandboxIDs
+func (c *CRIClient) GetReadyPodSandboxes() ([]*SandboxInfo, error) {
+	log.Infof("Getting ready pod sandboxes from %q", c.target())
+
+	var sandboxInfos []*SandboxInfo
+	err := c.call(func(ctx context.Context, service runtimeService) error {
+		// List all ready sandboxes from the CRI
+		var err error
+		sandboxInfos, err = service.ListReadyPodSandboxes(ctx)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-
-	sandboxInfos := make([]*SandboxInfo, 0, len(sandboxes.GetItems()))
-	for _, sandbox := range sandboxes.GetItems() {
-		info := SandboxInfo{
-			ContainerId: sandbox.Id,
-			PodName:     sandbox.Metadata.Name,
-			NameSpace:   sandbox.Metadata.Namespace,
-		}
-		sandboxInfos = append(sandboxInfos, &info)
-	}
+	c.pruneStatuses(sandboxInfos)
 	return sandboxInfos, nil
 }
@@ -0,0 +1,220 @@
+// Package fake implements an in-process CRI runtime service for driving the
+// cri client and its consumers without a real container runtime.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+	runtimeapialpha "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const (
+	APIVersionV1       = "v1"
+	APIVersionV1alpha2 = "v1alpha2"
+
+	RuntimeName    = "fake"
+	RuntimeVersion = "0.0.1"
+)
+
+// Sandbox is a pod sandbox served by the fake runtime.
+type Sandbox struct {
+	Id          string
+	Name        string
+	Namespace   string
+	Uid         string
+	Ready       bool
+	CreatedAt   time.Time
+	Labels      map[string]string
+	Annotations map[string]string
+	IPs         []string
+	HostNetwork bool
+	NetNSPath   string
+}
+
+// Runtime serves the CRI RuntimeService over a temporary unix socket. Only
+// Version, ListPodSandbox and PodSandboxStatus are implemented, other calls
+// return Unimplemented.
+type Runtime struct {
+	// Endpoint is the unix:// address of the runtime.
+	Endpoint string
+
+	dir    string
+	server *grpc.Server
+
+	lock      sync.Mutex
+	sandboxes map[string]*Sandbox
+	latency   time.Duration
+	errors    map[string]error
+	calls     map[string]int
+}
+
+// NewRuntime starts a fake runtime serving the given CRI API versions, both
+// v1 and v1alpha2 if none is given.
+func NewRuntime(apiVersions ...string) (*Runtime, error) {
+	if len(apiVersions) == 0 {
+		apiVersions = []string{APIVersionV1, APIVersionV1alpha2}
+	}
+
+	dir, err := ioutil.TempDir("", "fake-cri")
+	if err != nil {
+		return nil, err
+	}
+	socket := path.Join(dir, "cri.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	r := &Runtime{
+		Endpoint:  "unix://" + socket,
+		dir:       dir,
+		server:    grpc.NewServer(),
+		sandboxes: make(map[string]*Sandbox),
+		errors:    make(map[string]error),
+		calls:     make(map[string]int),
+	}
+	for _, version := range apiVersions {
+		switch version {
+		case APIVersionV1:
+			runtimeapi.RegisterRuntimeServiceServer(r.server, &v1Server{runtime: r})
+		case APIVersionV1alpha2:
+			runtimeapialpha.RegisterRuntimeServiceServer(r.server, &v1alpha2Server{runtime: r})
+		default:
+			listener.Close()
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("unknown CRI API version %s", version)
+		}
+	}
+	go r.server.Serve(listener)
+	return r, nil
+}
+
+// Stop stops serving and removes the socket.
+func (r *Runtime) Stop() {
+	r.server.Stop()
+	os.RemoveAll(r.dir)
+}
+
+// SetSandbox adds or replaces a sandbox, CreatedAt defaults to now.
+func (r *Runtime) SetSandbox(sandbox Sandbox) {
+	if sandbox.CreatedAt.IsZero() {
+		sandbox.CreatedAt = time.Now()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sandboxes[sandbox.Id] = &sandbox
+}
+
+// RemoveSandbox removes a sandbox.
+func (r *Runtime) RemoveSandbox(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.sandboxes, id)
+}
+
+// SetSandboxReady changes the state of a sandbox.
+func (r *Runtime) SetSandboxReady(id string, ready bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if sandbox, ok := r.sandboxes[id]; ok {
+		sandbox.Ready = ready
+	}
+}
+
+// SetLatency delays every call by latency, calls whose deadline expires
+// first fail with DeadlineExceeded.
+func (r *Runtime) SetLatency(latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.latency = latency
+}
+
+// InjectError makes calls of method, e.g. "ListPodSandbox", fail with err
+// until cleared with a nil err. Use grpc status errors to pick the code.
+func (r *Runtime) InjectError(method string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err == nil {
+		delete(r.errors, method)
+	} else {
+		r.errors[method] = err
+	}
+}
+
+// Calls returns how many times method has been called.
+func (r *Runtime) Calls(method string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.calls[method]
+}
+
+// intercept records a call of method, applies latency and returns the
+// injected error if any.
+func (r *Runtime) intercept(ctx context.Context, method string) error {
+	r.lock.Lock()
+	r.calls[method]++
+	latency := r.latency
+	err := r.errors[method]
+	r.lock.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// listSandboxes returns copies of sandboxes, only the ready ones if readyOnly.
+func (r *Runtime) listSandboxes(readyOnly bool) []Sandbox {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sandboxes := make([]Sandbox, 0, len(r.sandboxes))
+	for _, sandbox := range r.sandboxes {
+		if readyOnly && !sandbox.Ready {
+			continue
+		}
+		sandboxes = append(sandboxes, *sandbox)
+	}
+	return sandboxes
+}
+
+func (r *Runtime) getSandbox(id string) (Sandbox, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	sandbox, ok := r.sandboxes[id]
+	if !ok {
+		return Sandbox{}, false
+	}
+	return *sandbox, true
+}
+
+// verboseInfo mimics the verbose info containerd reports for a sandbox.
+func verboseInfo(sandbox Sandbox) map[string]string {
+	type namespace struct {
+		Type string `json:"type"`
+		Path string `json:"path,omitempty"`
+	}
+	info := map[string]interface{}{
+		"runtimeSpec": map[string]interface{}{
+			"linux": map[string]interface{}{
+				"namespaces": []namespace{{Type: "network", Path: sandbox.NetNSPath}},
+			},
+		},
+	}
+	data, _ := json.Marshal(info)
+	return map[string]string{"info": string(data)}
+}
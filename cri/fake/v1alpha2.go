@@ -0,0 +1,111 @@
+package fake
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+type v1alpha2Server struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	runtime *Runtime
+}
+
+func (s *v1alpha2Server) Version(ctx context.Context, req *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	if err := s.runtime.intercept(ctx, "Version"); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.VersionResponse{
+		Version:           "0.1.0",
+		RuntimeName:       RuntimeName,
+		RuntimeVersion:    RuntimeVersion,
+		RuntimeApiVersion: APIVersionV1alpha2,
+	}, nil
+}
+
+func (s *v1alpha2Server) ListPodSandbox(ctx context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	if err := s.runtime.intercept(ctx, "ListPodSandbox"); err != nil {
+		return nil, err
+	}
+
+	filter := req.GetFilter()
+	resp := &runtimeapi.ListPodSandboxResponse{}
+	for _, sandbox := range s.runtime.listSandboxes(false) {
+		state := v1alpha2State(sandbox.Ready)
+		if filter.GetState() != nil && filter.GetState().GetState() != state {
+			continue
+		}
+		if filter.GetId() != "" && filter.GetId() != sandbox.Id {
+			continue
+		}
+		resp.Items = append(resp.Items, &runtimeapi.PodSandbox{
+			Id:          sandbox.Id,
+			Metadata:    v1alpha2Metadata(sandbox),
+			State:       state,
+			CreatedAt:   sandbox.CreatedAt.UnixNano(),
+			Labels:      sandbox.Labels,
+			Annotations: sandbox.Annotations,
+		})
+	}
+	return resp, nil
+}
+
+func (s *v1alpha2Server) PodSandboxStatus(ctx context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	if err := s.runtime.intercept(ctx, "PodSandboxStatus"); err != nil {
+		return nil, err
+	}
+
+	sandbox, ok := s.runtime.getSandbox(req.GetPodSandboxId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %s not found", req.GetPodSandboxId())
+	}
+
+	networkMode := runtimeapi.NamespaceMode_POD
+	if sandbox.HostNetwork {
+		networkMode = runtimeapi.NamespaceMode_NODE
+	}
+	sandboxStatus := &runtimeapi.PodSandboxStatus{
+		Id:        sandbox.Id,
+		Metadata:  v1alpha2Metadata(sandbox),
+		State:     v1alpha2State(sandbox.Ready),
+		CreatedAt: sandbox.CreatedAt.UnixNano(),
+		Network:   &runtimeapi.PodSandboxNetworkStatus{},
+		Linux: &runtimeapi.LinuxPodSandboxStatus{
+			Namespaces: &runtimeapi.Namespace{
+				Options: &runtimeapi.NamespaceOption{Network: networkMode},
+			},
+		},
+		Labels:      sandbox.Labels,
+		Annotations: sandbox.Annotations,
+	}
+	for i, ip := range sandbox.IPs {
+		if i == 0 {
+			sandboxStatus.Network.Ip = ip
+		} else {
+			sandboxStatus.Network.AdditionalIps = append(sandboxStatus.Network.AdditionalIps, &runtimeapi.PodIP{Ip: ip})
+		}
+	}
+
+	resp := &runtimeapi.PodSandboxStatusResponse{Status: sandboxStatus}
+	if req.GetVerbose() {
+		resp.Info = verboseInfo(sandbox)
+	}
+	return resp, nil
+}
+
+func v1alpha2Metadata(sandbox Sandbox) *runtimeapi.PodSandboxMetadata {
+	return &runtimeapi.PodSandboxMetadata{
+		Name:      sandbox.Name,
+		Namespace: sandbox.Namespace,
+		Uid:       sandbox.Uid,
+	}
+}
+
+func v1alpha2State(ready bool) runtimeapi.PodSandboxState {
+	if ready {
+		return runtimeapi.PodSandboxState_SANDBOX_READY
+	}
+	return runtimeapi.PodSandboxState_SANDBOX_NOTREADY
+}
@@ -0,0 +1,93 @@
+package cri
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// v1alpha2RuntimeService talks runtime.v1alpha2, served by containerd 1.x and
+// dockershim.
+type v1alpha2RuntimeService struct {
+	client runtimeapi.RuntimeServiceClient
+}
+
+func newV1alpha2RuntimeService(conn *grpc.ClientConn) runtimeService {
+	return &v1alpha2RuntimeService{client: runtimeapi.NewRuntimeServiceClient(conn)}
+}
+
+func (s *v1alpha2RuntimeService) Version(ctx context.Context) (string, error) {
+	resp, err := s.client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		return "", err
+	}
+	return resp.RuntimeName + " " + resp.RuntimeVersion, nil
+}
+
+func (s *v1alpha2RuntimeService) ListReadyPodSandboxes(ctx context.Context) ([]*SandboxInfo, error) {
+	sandboxes, err := s.client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			State: &runtimeapi.PodSandboxStateValue{
+				State: runtimeapi.PodSandboxState_SANDBOX_READY,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxInfos := make([]*SandboxInfo, 0, len(sandboxes.GetItems()))
+	for _, sandbox := range sandboxes.GetItems() {
+		sandboxInfos = append(sandboxInfos, &SandboxInfo{
+			ContainerId: sandbox.Id,
+			PodName:     sandbox.GetMetadata().GetName(),
+			NameSpace:   sandbox.GetMetadata().GetNamespace(),
+			PodUID:      sandbox.GetMetadata().GetUid(),
+			State:       v1alpha2SandboxState(sandbox.State),
+			CreatedAt:   time.Unix(0, sandbox.CreatedAt),
+			Labels:      sandbox.Labels,
+			Annotations: sandbox.Annotations,
+		})
+	}
+	return sandboxInfos, nil
+}
+
+func (s *v1alpha2RuntimeService) PodSandboxStatus(ctx context.Context, sandboxId string) (*SandboxInfo, error) {
+	resp, err := s.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{
+		PodSandboxId: sandboxId,
+		Verbose:      true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	status := resp.GetStatus()
+	info := &SandboxInfo{
+		ContainerId: status.GetId(),
+		PodName:     status.GetMetadata().GetName(),
+		NameSpace:   status.GetMetadata().GetNamespace(),
+		PodUID:      status.GetMetadata().GetUid(),
+		State:       v1alpha2SandboxState(status.GetState()),
+		CreatedAt:   time.Unix(0, status.GetCreatedAt()),
+		Labels:      status.GetLabels(),
+		Annotations: status.GetAnnotations(),
+		HostNetwork: status.GetLinux().GetNamespaces().GetOptions().GetNetwork() == runtimeapi.NamespaceMode_NODE,
+		NetNSPath:   netNSPathFromInfo(resp.GetInfo()),
+	}
+	if status.GetNetwork().GetIp() != "" {
+		info.IPs = append(info.IPs, status.GetNetwork().GetIp())
+	}
+	for _, ip := range status.GetNetwork().GetAdditionalIps() {
+		info.IPs = append(info.IPs, ip.GetIp())
+	}
+	return info, nil
+}
+
+func v1alpha2SandboxState(state runtimeapi.PodSandboxState) string {
+	if state == runtimeapi.PodSandboxState_SANDBOX_READY {
+		return SandboxReady
+	}
+	return SandboxNotReady
+}
@@ -0,0 +1,123 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+)
+
+const (
+	SandboxReady    = "READY"
+	SandboxNotReady = "NOTREADY"
+)
+
+type SandboxInfo struct {
+	ContainerId string
+	PodName     string
+	NameSpace   string
+	PodUID      string
+	State       string
+	CreatedAt   time.Time
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// Fields below are only filled by GetPodSandboxStatus.
+
+	// IPs are the pod ips reported by the runtime.
+	IPs         []string
+	HostNetwork bool
+	// NetNSPath is the network namespace of the sandbox, empty if the
+	// runtime does not report it.
+	NetNSPath string
+}
+
+// verboseInfo is the part of the verbose PodSandboxStatus info used by the
+// agent, containerd and CRI-O both report it under the "info" key.
+type verboseInfo struct {
+	RuntimeSpec *struct {
+		Linux *struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// netNSPathFromInfo finds the network namespace path in the verbose info of
+// PodSandboxStatus. /proc/<pid>/ns/net of the sandbox pid is not used, since
+// the pid is of the host pid namespace.
+func netNSPathFromInfo(info map[string]string) string {
+	raw, ok := info["info"]
+	if !ok {
+		return ""
+	}
+	var vi verboseInfo
+	if err := json.Unmarshal([]byte(raw), &vi); err != nil {
+		return ""
+	}
+	if vi.RuntimeSpec != nil && vi.RuntimeSpec.Linux != nil {
+		for _, ns := range vi.RuntimeSpec.Linux.Namespaces {
+			if ns.Type == "network" && ns.Path != "" {
+				return ns.Path
+			}
+		}
+	}
+	return ""
+}
+
+// GetPodSandboxStatus returns the full info of the sandbox. Statuses are
+// cached per sandbox until it leaves the ready list, so the runtime is asked
+// only once per sandbox.
+func (c *CRIClient) GetPodSandboxStatus(sandboxId string) (*SandboxInfo, error) {
+	c.statusLock.Lock()
+	cached, ok := c.statuses[sandboxId]
+	c.statusLock.Unlock()
+	if ok {
+		info := *cached
+		return &info, nil
+	}
+
+	var info *SandboxInfo
+	err := c.call(func(ctx context.Context, service runtimeService) error {
+		var err error
+		info, err = service.PodSandboxStatus(ctx, sandboxId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.NetNSPath != "" {
+		info.NetNSPath = path.Join("/", c.hostRoot, info.NetNSPath)
+	}
+
+	c.statusLock.Lock()
+	if c.statuses == nil {
+		c.statuses = make(map[string]*SandboxInfo)
+	}
+	cached = &SandboxInfo{}
+	*cached = *info
+	c.statuses[sandboxId] = cached
+	c.statusLock.Unlock()
+	return info, nil
+}
+
+// pruneStatuses drops cached statuses of sandboxes not in ready any more, and
+// refreshes the state of the others.
+func (c *CRIClient) pruneStatuses(ready []*SandboxInfo) {
+	readySet := make(map[string]*SandboxInfo, len(ready))
+	for _, sandbox := range ready {
+		readySet[sandbox.ContainerId] = sandbox
+	}
+
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	for id, cached := range c.statuses {
+		if sandbox, ok := readySet[id]; ok {
+			cached.State = sandbox.State
+		} else {
+			delete(c.statuses, id)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Package events records kubernetes events on behalf of the agent.
+package events
+
+import (
+	log "github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const component = "tke-bridge-agent"
+
+// NewRecorder returns a recorder sending events of host through client.
+// Identical events are aggregated and rate limited by client-go, so that
+// periodic passes don't flood the api server.
+func NewRecorder(client kubernetes.Interface, host string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(log.V(2).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component, Host: host})
+}
+
+// NodeReference returns the reference of node used as event object.
+func NodeReference(nodeName string) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: nodeName,
+		UID:  types.UID(nodeName),
+	}
+}
+
+// PodReference returns the reference of pod namespace/name used as event object.
+func PodReference(namespace, name string, uid types.UID) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: namespace,
+		Name:      name,
+		UID:       uid,
+	}
+}
@@ -0,0 +1,150 @@
+package firewall
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	BackendAuto           = "auto"
+	BackendIPTablesLegacy = "iptables-legacy"
+	BackendIPTablesNFT    = "iptables-nft"
+	BackendNFTables       = "nftables"
+)
+
+// Hook is where an agent owned chain takes effect.
+type Hook string
+
+const (
+	// HookForward is the filter of forwarded packets, i.e. FORWARD of the
+	// iptables filter table.
+	HookForward Hook = "forward"
+	// HookPostrouting is the source nat of outgoing packets, i.e.
+	// POSTROUTING of the iptables nat table.
+	HookPostrouting Hook = "postrouting"
+)
+
+// Verdict is what a matched rule does with the packet.
+type Verdict string
+
+const (
+	VerdictAccept     Verdict = "accept"
+	VerdictReturn     Verdict = "return"
+	VerdictMasquerade Verdict = "masquerade"
+)
+
+// Chain is an agent owned chain.
+type Chain struct {
+	Name string
+	Hook Hook
+	// Comment describes the chain on the rule hooking it.
+	Comment string
+}
+
+// Rule is a rule of an agent owned chain, independent of the backend. Empty
+// fields match anything.
+type Rule struct {
+	// Src and Dst are cidrs, Src is negated by NotSrc.
+	Src    string
+	NotSrc bool
+	Dst    string
+	// InIface and OutIface are interface names.
+	InIface  string
+	OutIface string
+	// CtStates are conntrack states, e.g. ESTABLISHED.
+	CtStates []string
+	Comment  string
+	Verdict  Verdict
+}
+
+// Backend programs agent owned chains in a packet filtering framework.
+type Backend interface {
+	// Name returns the name of the backend, e.g. iptables-nft.
+	Name() string
+	// EnsureChain makes chain hold exactly rules, in order, and take effect
+	// at its hook. It returns whether anything was changed.
+	EnsureChain(chain Chain, rules []Rule) (bool, error)
+	// DeleteChain removes chain and the hooking of it.
+	DeleteChain(chain Chain) error
+}
+
+// NewBackend returns the backend of name, or the backend kube-proxy uses for
+// BackendAuto. guessed is true if no rules of kube-proxy are found, e.g. it
+// has not started yet, so that the backend should be detected again later.
+func NewBackend(name string) (backend Backend, guessed bool, err error) {
+	switch name {
+	case BackendIPTablesLegacy, BackendIPTablesNFT:
+		backend, err = newIPTablesBackend(name)
+	case BackendNFTables:
+		backend, err = newNFTablesBackend()
+	case BackendAuto, "":
+		return detectBackend()
+	default:
+		err = fmt.Errorf("unknown firewall backend %q", name)
+	}
+	return backend, false, err
+}
+
+// detectBackend picks the backend holding the rules of kube-proxy, so that
+// the rules of the agent and kube-proxy are evaluated together. Without any
+// rules of kube-proxy, the backend of the iptables command is guessed.
+func detectBackend() (Backend, bool, error) {
+	if nft, err := newNFTablesBackend(); err == nil && nft.hasKubeProxyTable() {
+		log.Infof("firewall: kube-proxy uses nftables")
+		if name := IPTablesForwardDrop(); name != "" {
+			log.Warningf("firewall: FORWARD of %s drops by default, which the forward rules of %s cannot override",
+				name, BackendNFTables)
+		}
+		return nft, false, nil
+	}
+
+	var best *iptablesBackend
+	var bestCount int
+	for _, name := range []string{BackendIPTablesNFT, BackendIPTablesLegacy} {
+		backend, err := newIPTablesBackend(name)
+		if err != nil {
+			log.V(4).Infof("firewall: %s is unavailable: %v", name, err)
+			continue
+		}
+		count := backend.kubeRuleCount()
+		log.V(2).Infof("firewall: found %d kube-proxy rules by %s", count, name)
+		if best == nil || count > bestCount {
+			best, bestCount = backend, count
+		}
+	}
+	if best == nil {
+		return nil, false, fmt.Errorf("none of %s, %s and %s is available", BackendNFTables, BackendIPTablesNFT, BackendIPTablesLegacy)
+	}
+	if bestCount == 0 {
+		name := BackendIPTablesLegacy
+		if out, err := exec.Command("iptables", "--version").CombinedOutput(); err == nil && strings.Contains(string(out), "nf_tables") {
+			name = BackendIPTablesNFT
+		}
+		if backend, err := newIPTablesBackend(name); err == nil {
+			best = backend
+		}
+		log.Warningf("firewall: no kube-proxy rules found, use %s as the iptables command does until they show up", best.Name())
+		return best, true, nil
+	}
+	log.Infof("firewall: kube-proxy uses %s", best.Name())
+	return best, false, nil
+}
+
+// IPTablesForwardDrop returns the iptables backend whose FORWARD chain drops
+// by default, empty if none. Base chains of the nftables backend cannot
+// accept packets dropped there.
+func IPTablesForwardDrop() string {
+	for _, name := range []string{BackendIPTablesNFT, BackendIPTablesLegacy} {
+		backend, err := newIPTablesBackend(name)
+		if err != nil {
+			continue
+		}
+		if backend.policy("filter", "FORWARD") == "DROP" {
+			return name
+		}
+	}
+	return ""
+}
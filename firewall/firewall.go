@@ -0,0 +1,167 @@
+// Package firewall keeps the packet filtering rules bridge pods rely on
+// converged, in chains owned by the agent.
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultCheckInterval = time.Minute
+)
+
+var firewallRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "firewall_repairs_total",
+	Help:      "Number of times an agent owned chain or its jump was found missing or changed and restored.",
+}, []string{"chain"})
+
+func init() {
+	prometheus.MustRegister(firewallRepairs)
+}
+
+// Config holds the settings of a Manager.
+type Config struct {
+	// BridgeName is the bridge of pods.
+	BridgeName string
+	// Backend is the name of the backend programming the rules, BackendAuto
+	// follows kube-proxy.
+	Backend string
+	// CheckInterval is the interval of verifying the rules.
+	CheckInterval time.Duration
+	// MasqConfig enables masquerading pod traffic, except to the non
+	// masquerade cidrs, nil disables it.
+	MasqConfig *MasqConfig
+}
+
+// Manager programs the agent owned chains for the pod cidr.
+type Manager struct {
+	backend Backend
+	// guessedBackend is true while kube-proxy has no rules to detect its
+	// backend by, which is detected again on every converge
+	guessedBackend bool
+	bridgeName     string
+	checkInterval  time.Duration
+
+	podCIDRLock sync.Mutex
+	podCIDR     *net.IPNet
+
+	masqLock   sync.Mutex
+	masqConfig *MasqConfig
+
+	trigger chan struct{}
+}
+
+// New returns a Manager programming rules by the backend of config.
+func New(config Config) (*Manager, error) {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	backend, guessed, err := NewBackend(config.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init firewall backend: %v", err)
+	}
+	log.Infof("firewall: program rules by %s", backend.Name())
+	return &Manager{
+		backend:        backend,
+		guessedBackend: guessed,
+		bridgeName:     config.BridgeName,
+		checkInterval:  config.CheckInterval,
+		masqConfig:     config.MasqConfig,
+		trigger:        make(chan struct{}, 1),
+	}, nil
+}
+
+// SetPodCIDR updates the pod cidr of this node, and converges the rules
+// right away.
+func (m *Manager) SetPodCIDR(cidr *net.IPNet) {
+	m.podCIDRLock.Lock()
+	m.podCIDR = cidr
+	m.podCIDRLock.Unlock()
+	m.kick()
+}
+
+func (m *Manager) getPodCIDR() *net.IPNet {
+	m.podCIDRLock.Lock()
+	defer m.podCIDRLock.Unlock()
+	return m.podCIDR
+}
+
+func (m *Manager) kick() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run converges the rules whenever the pod cidr or the masquerade config
+// changes, and every check interval.
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.trigger:
+			m.converge()
+		case <-ticker.C:
+			m.converge()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) converge() {
+	podCIDR := m.getPodCIDR()
+	if podCIDR == nil {
+		return
+	}
+	if m.guessedBackend {
+		m.redetectBackend()
+	}
+	if err := m.ensureForward(podCIDR); err != nil {
+		log.Errorf("firewall: failed to ensure chain %s: %v", forwardChain.Name, err)
+	}
+	if err := m.ensureMasq(podCIDR); err != nil {
+		log.Errorf("firewall: failed to ensure chain %s: %v", masqChain.Name, err)
+	}
+}
+
+// redetectBackend detects the backend of kube-proxy again, and moves the
+// agent owned chains if it differs from the guessed one.
+func (m *Manager) redetectBackend() {
+	backend, guessed, err := NewBackend(BackendAuto)
+	if err != nil {
+		log.Errorf("firewall: failed to detect backend: %v", err)
+		return
+	}
+	m.guessedBackend = guessed
+	if backend.Name() == m.backend.Name() {
+		return
+	}
+	log.Warningf("firewall: kube-proxy uses %s, move rules from %s", backend.Name(), m.backend.Name())
+	if err := m.Cleanup(); err != nil {
+		log.Errorf("firewall: failed to clean up rules of %s: %v", m.backend.Name(), err)
+	}
+	m.backend = backend
+}
+
+// Cleanup removes every agent owned chain and the jumps to them.
+func (m *Manager) Cleanup() error {
+	var failed []error
+	for _, cleanup := range []func() error{m.cleanupForward, m.cleanupMasq} {
+		if err := cleanup(); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package firewall
+
+import (
+	"net"
+)
+
+// forwardChain accepts traffic to and from pods even if FORWARD drops by
+// default, e.g. set by docker or hardening scripts, so that pods stay
+// reachable from other nodes, node ports and advertised pod routes. Traffic
+// to other destinations is still subject to the FORWARD rules of others.
+var forwardChain = Chain{
+	Name:    "TKE-BRIDGE-FORWARD",
+	Hook:    HookForward,
+	Comment: "tke-bridge-agent forward rules",
+}
+
+func (m *Manager) forwardRules(podCIDR *net.IPNet) []Rule {
+	cidr := podCIDR.String()
+	established := []string{"RELATED", "ESTABLISHED"}
+	return []Rule{
+		{InIface: m.bridgeName, Src: cidr, Comment: "tke-bridge-agent accept traffic from pods", Verdict: VerdictAccept},
+		{OutIface: m.bridgeName, Dst: cidr, Comment: "tke-bridge-agent accept traffic to pods", Verdict: VerdictAccept},
+		{InIface: m.bridgeName, CtStates: established,
+			Comment: "tke-bridge-agent accept established flows from the bridge", Verdict: VerdictAccept},
+		{OutIface: m.bridgeName, CtStates: established,
+			Comment: "tke-bridge-agent accept established flows to the bridge", Verdict: VerdictAccept},
+	}
+}
+
+func (m *Manager) ensureForward(podCIDR *net.IPNet) error {
+	changed, err := m.backend.EnsureChain(forwardChain, m.forwardRules(podCIDR))
+	if changed {
+		firewallRepairs.WithLabelValues(forwardChain.Name).Inc()
+	}
+	return err
+}
+
+func (m *Manager) cleanupForward() error {
+	return m.backend.DeleteChain(forwardChain)
+}
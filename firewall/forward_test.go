@@ -0,0 +1,25 @@
+package firewall
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardRules(t *testing.T) {
+	_, podCIDR, _ := net.ParseCIDR("172.16.1.0/24")
+	m := &Manager{bridgeName: "cbr0"}
+	rules := m.forwardRules(podCIDR)
+
+	// new connections both from and to pods are accepted
+	var from, to bool
+	for _, rule := range rules {
+		if rule.Verdict != VerdictAccept || len(rule.CtStates) > 0 {
+			continue
+		}
+		from = from || rule.InIface == "cbr0" && rule.Src == "172.16.1.0/24" && rule.Dst == ""
+		to = to || rule.OutIface == "cbr0" && rule.Dst == "172.16.1.0/24" && rule.Src == ""
+	}
+	if !from || !to {
+		t.Errorf("expect traffic from and to pods accepted, got %+v", rules)
+	}
+}
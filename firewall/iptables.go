@@ -0,0 +1,200 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// iptablesBackend programs chains by an iptables command, iptables-legacy or
+// iptables-nft, which write to different kernel tables.
+type iptablesBackend struct {
+	name string
+	cmd  string
+}
+
+// newIPTablesBackend returns the backend of name, falling back to the plain
+// iptables command if it is of the same flavor, e.g. on images predating the
+// -legacy and -nft commands.
+func newIPTablesBackend(name string) (*iptablesBackend, error) {
+	if _, err := exec.LookPath(name); err == nil {
+		return &iptablesBackend{name: name, cmd: name}, nil
+	}
+	out, err := exec.Command("iptables", "--version").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("neither %s nor iptables is available: %v", name, err)
+	}
+	isNFT := strings.Contains(string(out), "nf_tables")
+	if isNFT != (name == BackendIPTablesNFT) {
+		return nil, fmt.Errorf("%s is not available, iptables is %s", name, strings.TrimSpace(string(out)))
+	}
+	return &iptablesBackend{name: name, cmd: "iptables"}, nil
+}
+
+func (b *iptablesBackend) Name() string {
+	return b.name
+}
+
+func (b *iptablesBackend) run(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(b.cmd, append([]string{"-w"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", b.cmd, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// exists runs iptables -C, which fails for rules not existing.
+func (b *iptablesBackend) exists(table, chain string, rule []string) bool {
+	_, err := b.run(append([]string{"-t", table, "-C", chain}, rule...)...)
+	return err == nil
+}
+
+func (b *iptablesBackend) hasChain(table, chain string) bool {
+	_, err := b.run("-t", table, "-S", chain)
+	return err == nil
+}
+
+// policy returns the policy of a builtin chain, empty if unknown.
+func (b *iptablesBackend) policy(table, chain string) string {
+	out, err := b.run("-t", table, "-S", chain)
+	if err != nil {
+		return ""
+	}
+	// the first line is e.g. -P FORWARD DROP
+	fields := strings.Fields(strings.SplitN(out, "\n", 2)[0])
+	if len(fields) != 3 || fields[0] != "-P" {
+		return ""
+	}
+	return fields[2]
+}
+
+// kubeRuleCount returns the number of rules of kube-proxy chains.
+func (b *iptablesBackend) kubeRuleCount() int {
+	var count int
+	for _, table := range []string{"nat", "filter"} {
+		out, err := b.run("-t", table, "-S")
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, "KUBE-") {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// hookOf returns the table and the builtin chain of hook.
+func hookOf(hook Hook) (table, parent string) {
+	switch hook {
+	case HookPostrouting:
+		return "nat", "POSTROUTING"
+	default:
+		return "filter", "FORWARD"
+	}
+}
+
+func jumpArgs(chain Chain) []string {
+	return []string{"-m", "comment", "--comment", chain.Comment, "-j", chain.Name}
+}
+
+func ruleArgs(rule Rule) []string {
+	var args []string
+	if rule.Src != "" {
+		if rule.NotSrc {
+			args = append(args, "!")
+		}
+		args = append(args, "-s", rule.Src)
+	}
+	if rule.Dst != "" {
+		args = append(args, "-d", rule.Dst)
+	}
+	if rule.InIface != "" {
+		args = append(args, "-i", rule.InIface)
+	}
+	if rule.OutIface != "" {
+		args = append(args, "-o", rule.OutIface)
+	}
+	if len(rule.CtStates) > 0 {
+		args = append(args, "-m", "conntrack", "--ctstate", strings.Join(rule.CtStates, ","))
+	}
+	if rule.Comment != "" {
+		args = append(args, "-m", "comment", "--comment", rule.Comment)
+	}
+	return append(args, "-j", strings.ToUpper(string(rule.Verdict)))
+}
+
+func (b *iptablesBackend) EnsureChain(chain Chain, rules []Rule) (bool, error) {
+	table, parent := hookOf(chain.Hook)
+	var changed bool
+	if !b.hasChain(table, chain.Name) {
+		log.Infof("firewall: create chain %s in %s by %s", chain.Name, table, b.name)
+		if _, err := b.run("-t", table, "-N", chain.Name); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	out, err := b.run("-t", table, "-S", chain.Name)
+	if err != nil {
+		return changed, err
+	}
+	current := strings.Split(strings.TrimSpace(out), "\n")
+	// the first line is the -N of the chain
+	synced := len(current) == len(rules)+1
+	for i := 0; synced && i < len(rules); i++ {
+		synced = b.exists(table, chain.Name, ruleArgs(rules[i]))
+	}
+	if !synced {
+		log.Infof("firewall: rewrite chain %s in %s by %s", chain.Name, table, b.name)
+		if _, err := b.run("-t", table, "-F", chain.Name); err != nil {
+			return changed, err
+		}
+		for _, rule := range rules {
+			if _, err := b.run(append([]string{"-t", table, "-A", chain.Name}, ruleArgs(rule)...)...); err != nil {
+				return true, err
+			}
+		}
+		changed = true
+	}
+
+	if !b.exists(table, parent, jumpArgs(chain)) {
+		// insert at first, so that rules of others do not take effect before
+		// ours: drop rules, e.g. of docker, before the forward chain which
+		// only accepts traffic of pods, and snat rules before the masquerade
+		// chain which returns all but pod traffic to masqueraded destinations
+		log.Infof("firewall: insert jump to %s into %s of %s by %s", chain.Name, parent, table, b.name)
+		if _, err := b.run(append([]string{"-t", table, "-I", parent, "1"}, jumpArgs(chain)...)...); err != nil {
+			return true, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+func (b *iptablesBackend) DeleteChain(chain Chain) error {
+	table, parent := hookOf(chain.Hook)
+	for b.exists(table, parent, jumpArgs(chain)) {
+		if _, err := b.run(append([]string{"-t", table, "-D", parent}, jumpArgs(chain)...)...); err != nil {
+			return err
+		}
+	}
+	if !b.hasChain(table, chain.Name) {
+		return nil
+	}
+	if _, err := b.run("-t", table, "-F", chain.Name); err != nil {
+		return err
+	}
+	if _, err := b.run("-t", table, "-X", chain.Name); err != nil {
+		return err
+	}
+	log.Infof("firewall: deleted chain %s of %s by %s", chain.Name, table, b.name)
+	return nil
+}
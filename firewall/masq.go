@@ -0,0 +1,116 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	linkLocal     = "169.254.0.0/16"
+	masqConfigKey = "config"
+)
+
+// masqChain masquerades pod traffic. It returns for traffic not from pods
+// itself, so that the hooking does not change with the pod cidr.
+var masqChain = Chain{
+	Name:    "TKE-BRIDGE-MASQ",
+	Hook:    HookPostrouting,
+	Comment: "tke-bridge-agent masquerade rules",
+}
+
+// MasqConfig is which pod traffic is not masqueraded, in the format of the
+// ip-masq-agent ConfigMap.
+type MasqConfig struct {
+	// NonMasqueradeCIDRs are destinations reached with pod ips, besides the
+	// pod cidr.
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs"`
+	// MasqLinkLocal masquerades traffic to 169.254.0.0/16 too.
+	MasqLinkLocal bool `json:"masqLinkLocal"`
+}
+
+// Validate checks the cidrs of c.
+func (c *MasqConfig) Validate() error {
+	for _, cidr := range c.NonMasqueradeCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid non masquerade cidr %q: %v", cidr, err)
+		}
+	}
+	return nil
+}
+
+// ParseMasqConfig parses the config key of a masquerade ConfigMap. A missing
+// or empty key is invalid, rather than masquerading traffic to every
+// destination but the pod cidr.
+func ParseMasqConfig(data map[string]string) (*MasqConfig, error) {
+	raw, ok := data[masqConfigKey]
+	if !ok || strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("missing or empty %s", masqConfigKey)
+	}
+	config := &MasqConfig{}
+	if err := yaml.Unmarshal([]byte(raw), config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", masqConfigKey, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// SetMasqConfig replaces which pod traffic is not masqueraded, and converges
+// the rules right away.
+func (m *Manager) SetMasqConfig(config *MasqConfig) {
+	m.masqLock.Lock()
+	m.masqConfig = config
+	m.masqLock.Unlock()
+	m.kick()
+}
+
+func (m *Manager) getMasqConfig() *MasqConfig {
+	m.masqLock.Lock()
+	defer m.masqLock.Unlock()
+	return m.masqConfig
+}
+
+// masqRules masquerade pod traffic, except to the pod cidr and the non
+// masquerade cidrs, each returned once in canonical form.
+func masqRules(podCIDR *net.IPNet, config *MasqConfig) []Rule {
+	cidr := podCIDR.String()
+	rules := []Rule{
+		{Src: cidr, NotSrc: true, Verdict: VerdictReturn},
+		{Dst: cidr, Comment: "tke-bridge-agent do not masquerade pod to pod traffic", Verdict: VerdictReturn},
+	}
+	seen := map[string]bool{cidr: true}
+	for _, nonMasq := range config.NonMasqueradeCIDRs {
+		if _, ipNet, err := net.ParseCIDR(nonMasq); err == nil {
+			nonMasq = ipNet.String()
+		}
+		if seen[nonMasq] {
+			continue
+		}
+		seen[nonMasq] = true
+		rules = append(rules, Rule{Dst: nonMasq, Comment: "tke-bridge-agent non masquerade cidr", Verdict: VerdictReturn})
+	}
+	if !config.MasqLinkLocal {
+		rules = append(rules, Rule{Dst: linkLocal, Comment: "tke-bridge-agent do not masquerade link local traffic", Verdict: VerdictReturn})
+	}
+	return append(rules, Rule{Comment: "tke-bridge-agent masquerade pod traffic", Verdict: VerdictMasquerade})
+}
+
+func (m *Manager) ensureMasq(podCIDR *net.IPNet) error {
+	config := m.getMasqConfig()
+	if config == nil {
+		return m.cleanupMasq()
+	}
+	changed, err := m.backend.EnsureChain(masqChain, masqRules(podCIDR, config))
+	if changed {
+		firewallRepairs.WithLabelValues(masqChain.Name).Inc()
+	}
+	return err
+}
+
+func (m *Manager) cleanupMasq() error {
+	return m.backend.DeleteChain(masqChain)
+}
@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseMasqConfig(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		data   map[string]string
+		expect *MasqConfig
+		err    bool
+	}{
+		{name: "no config", data: map[string]string{}, err: true},
+		{name: "empty config", data: map[string]string{"config": " \n"}, err: true},
+		{name: "invalid yaml", data: map[string]string{"config": "nonMasqueradeCIDRs: 10.0.0.0/8"}, err: true},
+		{name: "invalid cidr", data: map[string]string{"config": "nonMasqueradeCIDRs: [10.0.0.0/33]"}, err: true},
+		{name: "ip without prefix length", data: map[string]string{"config": "nonMasqueradeCIDRs: [10.0.0.1]"}, err: true},
+		{
+			name:   "yaml",
+			data:   map[string]string{"config": "nonMasqueradeCIDRs:\n  - 10.0.0.0/8\nmasqLinkLocal: true\n"},
+			expect: &MasqConfig{NonMasqueradeCIDRs: []string{"10.0.0.0/8"}, MasqLinkLocal: true},
+		},
+		{
+			name:   "json",
+			data:   map[string]string{"config": `{"nonMasqueradeCIDRs": ["10.0.0.0/8", "192.168.0.0/16"]}`},
+			expect: &MasqConfig{NonMasqueradeCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		},
+		{
+			name:   "duplicate cidrs",
+			data:   map[string]string{"config": "nonMasqueradeCIDRs: [10.0.0.0/8, 10.0.0.0/8]"},
+			expect: &MasqConfig{NonMasqueradeCIDRs: []string{"10.0.0.0/8", "10.0.0.0/8"}},
+		},
+		{name: "no cidrs", data: map[string]string{"config": "masqLinkLocal: false"}, expect: &MasqConfig{}},
+	} {
+		config, err := ParseMasqConfig(c.data)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expect error, got %+v", c.name, config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, c.expect) {
+			t.Errorf("%s: expect %+v, got %+v", c.name, c.expect, config)
+		}
+	}
+}
+
+func TestMasqRules(t *testing.T) {
+	_, podCIDR, _ := net.ParseCIDR("172.16.1.0/24")
+	head := []Rule{
+		{Src: "172.16.1.0/24", NotSrc: true, Verdict: VerdictReturn},
+		{Dst: "172.16.1.0/24", Comment: "tke-bridge-agent do not masquerade pod to pod traffic", Verdict: VerdictReturn},
+	}
+	nonMasq := func(cidr string) Rule {
+		return Rule{Dst: cidr, Comment: "tke-bridge-agent non masquerade cidr", Verdict: VerdictReturn}
+	}
+	linkLocalRule := Rule{Dst: linkLocal, Comment: "tke-bridge-agent do not masquerade link local traffic", Verdict: VerdictReturn}
+	masq := Rule{Comment: "tke-bridge-agent masquerade pod traffic", Verdict: VerdictMasquerade}
+
+	for _, c := range []struct {
+		name   string
+		config *MasqConfig
+		expect []Rule
+	}{
+		{
+			name:   "empty",
+			config: &MasqConfig{},
+			expect: append(append([]Rule{}, head...), linkLocalRule, masq),
+		},
+		{
+			name:   "masquerade link local",
+			config: &MasqConfig{MasqLinkLocal: true},
+			expect: append(append([]Rule{}, head...), masq),
+		},
+		{
+			name:   "non masquerade cidrs",
+			config: &MasqConfig{NonMasqueradeCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+			expect: append(append([]Rule{}, head...), nonMasq("10.0.0.0/8"), nonMasq("192.168.0.0/16"), linkLocalRule, masq),
+		},
+		{
+			name:   "duplicate and non canonical cidrs",
+			config: &MasqConfig{NonMasqueradeCIDRs: []string{"10.0.0.0/8", "10.1.2.3/8", "172.16.1.0/24"}},
+			expect: append(append([]Rule{}, head...), nonMasq("10.0.0.0/8"), linkLocalRule, masq),
+		},
+	} {
+		if got := masqRules(podCIDR, c.config); !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("%s: expect %+v, got %+v", c.name, c.expect, got)
+		}
+	}
+}
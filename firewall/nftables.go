@@ -0,0 +1,163 @@
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	// nftTable is the table holding every agent owned chain.
+	nftTable = "tke-bridge-agent"
+	// kubeProxyNFTTable is the table of kube-proxy in nftables mode.
+	kubeProxyNFTTable = "kube-proxy"
+)
+
+// nftablesBackend programs chains as base chains of an agent owned table by
+// the nft command. Each chain is rewritten in one transaction.
+//
+// Unlike iptables, an accept in one base chain does not stop packets from
+// being dropped by other base chains of the same hook, e.g. FORWARD of
+// iptables-nft with policy DROP.
+type nftablesBackend struct {
+	lock sync.Mutex
+	// applied is the ruleset last written of each chain
+	applied map[string]string
+}
+
+func newNFTablesBackend() (*nftablesBackend, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, err
+	}
+	return &nftablesBackend{applied: make(map[string]string)}, nil
+}
+
+func (b *nftablesBackend) Name() string {
+	return BackendNFTables
+}
+
+func (b *nftablesBackend) run(script string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("nft", args...)
+	if script != "" {
+		cmd.Stdin = strings.NewReader(script)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (b *nftablesBackend) hasKubeProxyTable() bool {
+	_, err := b.run("", "list", "table", "ip", kubeProxyNFTTable)
+	return err == nil
+}
+
+// baseChainSpec returns the type, hook and priority of a base chain at hook.
+func baseChainSpec(hook Hook) string {
+	switch hook {
+	case HookPostrouting:
+		return "type nat hook postrouting priority 100; policy accept;"
+	default:
+		return "type filter hook forward priority 0; policy accept;"
+	}
+}
+
+func nftRule(rule Rule) string {
+	var parts []string
+	if rule.Src != "" {
+		if rule.NotSrc {
+			parts = append(parts, "ip saddr !=", rule.Src)
+		} else {
+			parts = append(parts, "ip saddr", rule.Src)
+		}
+	}
+	if rule.Dst != "" {
+		parts = append(parts, "ip daddr", rule.Dst)
+	}
+	if rule.InIface != "" {
+		parts = append(parts, fmt.Sprintf("iifname %q", rule.InIface))
+	}
+	if rule.OutIface != "" {
+		parts = append(parts, fmt.Sprintf("oifname %q", rule.OutIface))
+	}
+	if len(rule.CtStates) > 0 {
+		parts = append(parts, fmt.Sprintf("ct state { %s }", strings.ToLower(strings.Join(rule.CtStates, ", "))))
+	}
+	parts = append(parts, string(rule.Verdict))
+	if rule.Comment != "" {
+		parts = append(parts, fmt.Sprintf("comment %q", rule.Comment))
+	}
+	return strings.Join(parts, " ")
+}
+
+// chainRuleCount returns the number of rules of chain, -1 if it is missing.
+func (b *nftablesBackend) chainRuleCount(chain string) int {
+	out, err := b.run("", "list", "chain", "ip", nftTable, chain)
+	if err != nil {
+		return -1
+	}
+	var count int
+	var inChain bool
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "chain "):
+			inChain = true
+		case !inChain, line == "", line == "}", strings.HasPrefix(line, "type "):
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+func (b *nftablesBackend) EnsureChain(chain Chain, rules []Rule) (bool, error) {
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table ip %s\n", nftTable)
+	fmt.Fprintf(&script, "add chain ip %s %s { %s }\n", nftTable, chain.Name, baseChainSpec(chain.Hook))
+	fmt.Fprintf(&script, "flush chain ip %s %s\n", nftTable, chain.Name)
+	for _, rule := range rules {
+		fmt.Fprintf(&script, "add rule ip %s %s %s\n", nftTable, chain.Name, nftRule(rule))
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.applied[chain.Name] == script.String() && b.chainRuleCount(chain.Name) == len(rules) {
+		return false, nil
+	}
+	log.Infof("firewall: rewrite chain %s of table %s by nft", chain.Name, nftTable)
+	if _, err := b.run(script.String(), "-f", "-"); err != nil {
+		delete(b.applied, chain.Name)
+		return true, err
+	}
+	b.applied[chain.Name] = script.String()
+	return true, nil
+}
+
+func (b *nftablesBackend) DeleteChain(chain Chain) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.applied, chain.Name)
+	if b.chainRuleCount(chain.Name) < 0 {
+		return nil
+	}
+	if _, err := b.run("", "delete", "chain", "ip", nftTable, chain.Name); err != nil {
+		return err
+	}
+	log.Infof("firewall: deleted chain %s of table %s by nft", chain.Name, nftTable)
+
+	out, err := b.run("", "list", "table", "ip", nftTable)
+	if err == nil && !strings.Contains(out, "chain ") {
+		if _, err := b.run("", "delete", "table", "ip", nftTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package iprule
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qyzhaoxun/tke-bridge-agent/events"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	localTable   = 255
+	mainTable    = 254
+	defaultTable = 253
+)
+
+var ruleConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "policy_rule_conflicts",
+	Help:      "Number of rules of others the agent cannot coexist with without overriding them.",
+})
+
+func init() {
+	prometheus.MustRegister(ruleConflicts)
+}
+
+// eniRules are the rules of tke-route-eni found on the node. Every eni pod
+// has a rule sending its traffic to the route table of its eni, which
+// holds a default route through the eni.
+type eniRules struct {
+	// podIPs are the sources of the rules, i.e. ips of eni pods.
+	podIPs []*net.IPNet
+	// tables are the route tables of enis.
+	tables map[int]bool
+	// minPriority is the minimal preference of the rules, 0 if none found.
+	minPriority int
+}
+
+// detectENI finds the rules of tke-route-eni in rules, which are from a
+// single ip to a table other than the well known ones and the table of the
+// agent, holding a default route.
+func (m *Manager) detectENI(rules []netlink.Rule) *eniRules {
+	eni := &eniRules{tables: make(map[int]bool)}
+	for _, rule := range rules {
+		if rule.Flow == m.config.Realm || rule.Src == nil || rule.Dst != nil {
+			continue
+		}
+		if ones, bits := rule.Src.Mask.Size(); ones != bits {
+			continue
+		}
+		switch rule.Table {
+		case localTable, mainTable, defaultTable, m.config.Table:
+			continue
+		}
+		if !eni.tables[rule.Table] {
+			if !hasDefaultRoute(rule.Table) {
+				continue
+			}
+			eni.tables[rule.Table] = true
+		}
+		eni.podIPs = append(eni.podIPs, rule.Src)
+		if eni.minPriority == 0 || rule.Priority < eni.minPriority {
+			eni.minPriority = rule.Priority
+		}
+	}
+	return eni
+}
+
+func hasDefaultRoute(table int) bool {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.Warningf("iprule: failed to list routes of table %d: %v", table, err)
+		return false
+	}
+	for _, route := range routes {
+		if route.Dst == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// coexist returns the preference of the agent rules, which must take effect
+// ahead of the eni rules, so that replies of eni pods to bridge pods go
+// through the bridge instead of the eni. It also returns the conflicts which
+// cannot be resolved without overriding rules of others.
+func (m *Manager) coexist(podCIDR *net.IPNet, eni *eniRules, rules []netlink.Rule) (int, []string) {
+	var conflicts []string
+	priority := m.config.Priority
+	if eni.minPriority > 0 && eni.minPriority <= priority {
+		if eni.minPriority <= 1 {
+			conflicts = append(conflicts, fmt.Sprintf("eni rules take effect at pref %d, no pref is left ahead of them", eni.minPriority))
+		} else {
+			priority = eni.minPriority - 1
+		}
+	}
+
+	for _, ip := range eni.podIPs {
+		if podCIDR.Contains(ip.IP) {
+			conflicts = append(conflicts, fmt.Sprintf("eni pod ip %s is in pod cidr %s", ip.IP, podCIDR))
+		}
+	}
+
+	dsts := append([]*net.IPNet{podCIDR}, m.config.CIDRs...)
+	for _, rule := range rules {
+		if rule.Flow == m.config.Realm || rule.Dst == nil || rule.Priority >= priority {
+			continue
+		}
+		if rule.Table == m.config.Table || rule.Table == localTable || !plain(rule) {
+			continue
+		}
+		for _, dst := range dsts {
+			if overlaps(rule.Dst, dst) {
+				conflicts = append(conflicts, fmt.Sprintf("rule %q routes %s by table %d ahead of the agent rules", describe(rule), dst, rule.Table))
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return priority, conflicts
+}
+
+// reportConflicts logs and records conflicts as events if they changed.
+func (m *Manager) reportConflicts(conflicts []string) {
+	ruleConflicts.Set(float64(len(conflicts)))
+	joined := strings.Join(conflicts, "; ")
+	if joined == m.conflicts {
+		return
+	}
+	m.conflicts = joined
+	if len(conflicts) == 0 {
+		log.Infof("iprule: no conflicts with eni rules")
+		return
+	}
+	for _, conflict := range conflicts {
+		log.Warningf("iprule: conflict with eni rules: %s", conflict)
+	}
+	if m.config.Recorder != nil {
+		m.config.Recorder.Eventf(events.NodeReference(m.config.NodeName), v1.EventTypeWarning, "PolicyRuleConflict",
+			"policy routing rules of bridge pods conflict with others: %s", joined)
+	}
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,328 @@
+// Package iprule keeps the policy routing rules steering traffic of bridge
+// pods to a route table, typically main, ahead of rules of others, e.g.
+// tke-route-eni.
+package iprule
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	DefaultPriority = 1024
+	// DefaultTable is the main route table.
+	DefaultTable = 254
+	// DefaultRealm tags the rules owned by the agent. The kernel keeps no
+	// owner of a rule, and the protocol of rules is fixed by netlink, so the
+	// realm, which only matters to realm based classification, is used.
+	DefaultRealm = 0x6b62
+
+	DefaultCheckInterval = time.Minute
+)
+
+var ruleRestorations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "policy_rule_restorations_total",
+	Help:      "Number of times an agent owned policy routing rule was found missing and restored.",
+}, []string{"rule"})
+
+func init() {
+	prometheus.MustRegister(ruleRestorations)
+}
+
+// Config holds the settings of a Manager.
+type Config struct {
+	// Priority is the preference of the rules.
+	Priority int
+	// Table is the route table the rules look up.
+	Table int
+	// Realm tags the rules owned by the agent, only rules of the realm are
+	// deleted when no longer desired.
+	Realm int
+	// CIDRs are destinations besides the pod cidr, e.g. the service cidr.
+	CIDRs []*net.IPNet
+	// FromPodCIDR adds a rule of traffic from the pod cidr as well.
+	FromPodCIDR bool
+	// CheckInterval is the interval of verifying the rules besides on
+	// netlink notifications.
+	CheckInterval time.Duration
+	// CoexistENI detects the rules of tke-route-eni, takes effect ahead of
+	// them, and reports the conflicts with them.
+	CoexistENI bool
+	// NodeName and Recorder record the conflicts as events of the node if
+	// Recorder is not nil.
+	NodeName string
+	Recorder record.EventRecorder
+}
+
+// Manager programs the rules of the pod cidr.
+type Manager struct {
+	config Config
+
+	podCIDRLock sync.Mutex
+	podCIDR     *net.IPNet
+
+	trigger chan struct{}
+
+	// ensured are the keys of the rules ensured by the last converge,
+	// adding any of them again is a restoration
+	ensured map[string]bool
+	// priority is the preference used by the last converge, and conflicts
+	// are the conflicts reported last, joined
+	priority  int
+	conflicts string
+}
+
+// New returns a Manager of config, zero fields are defaulted.
+func New(config Config) *Manager {
+	if config.Priority <= 0 {
+		config.Priority = DefaultPriority
+	}
+	if config.Table <= 0 {
+		config.Table = DefaultTable
+	}
+	if config.Realm <= 0 {
+		config.Realm = DefaultRealm
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	return &Manager{
+		config:  config,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// SetPodCIDR updates the pod cidr of this node, and converges the rules
+// right away.
+func (m *Manager) SetPodCIDR(cidr *net.IPNet) {
+	if cidr.IP.IsLoopback() {
+		log.Warningf("iprule: loopback cidr %v, skip adding rules", cidr)
+		return
+	}
+	m.podCIDRLock.Lock()
+	m.podCIDR = cidr
+	m.podCIDRLock.Unlock()
+	m.kick()
+}
+
+func (m *Manager) getPodCIDR() *net.IPNet {
+	m.podCIDRLock.Lock()
+	defer m.podCIDRLock.Unlock()
+	return m.podCIDR
+}
+
+func (m *Manager) kick() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run converges the rules whenever the pod cidr or any rule changes, e.g.
+// rules flushed by others, and every check interval.
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+
+	var ruleCh chan struct{}
+	for {
+		// the channel is closed on errors, subscribe again
+		if ruleCh == nil {
+			ruleCh = make(chan struct{})
+			if err := ruleSubscribe(ruleCh, stopCh); err != nil {
+				log.Warningf("iprule: failed to subscribe rule updates: %v", err)
+				ruleCh = nil
+			}
+		}
+
+		select {
+		case <-m.trigger:
+			m.converge()
+		case <-ticker.C:
+			m.converge()
+		case _, ok := <-ruleCh:
+			if !ok {
+				ruleCh = nil
+				continue
+			}
+			// coalesce bursts, e.g. of ip rule flush
+			m.kick()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) converge() {
+	podCIDR := m.getPodCIDR()
+	if podCIDR == nil {
+		return
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		log.Errorf("iprule: failed to list rules: %v", err)
+		return
+	}
+	desired := m.desired(podCIDR, rules)
+	added, err := m.ensure(rules, desired)
+	for _, rule := range added {
+		if m.ensured[key(rule)] {
+			log.Warningf("iprule: rule %q was removed, restored it", describe(rule))
+			ruleRestorations.WithLabelValues(describe(rule)).Inc()
+		}
+	}
+	if err != nil {
+		log.Errorf("iprule: failed to ensure rules of %v: %v", podCIDR, err)
+		return
+	}
+	m.ensured = make(map[string]bool)
+	for _, rule := range desired {
+		m.ensured[key(rule)] = true
+	}
+}
+
+// desired returns the rules of podCIDR, given the current rules of the
+// node.
+func (m *Manager) desired(podCIDR *net.IPNet, current []netlink.Rule) []netlink.Rule {
+	priority := m.config.Priority
+	var eni *eniRules
+	if m.config.CoexistENI {
+		eni = m.detectENI(current)
+		var conflicts []string
+		priority, conflicts = m.coexist(podCIDR, eni, current)
+		if priority != m.priority && priority != m.config.Priority {
+			log.Infof("iprule: eni rules take effect from pref %d, use pref %d", eni.minPriority, priority)
+		}
+		m.priority = priority
+		m.reportConflicts(conflicts)
+	}
+
+	var rules []netlink.Rule
+	for _, dst := range append([]*net.IPNet{podCIDR}, m.config.CIDRs...) {
+		rule := m.newRule(priority, m.config.Table)
+		rule.Dst = dst
+		rules = append(rules, *rule)
+	}
+	if m.config.FromPodCIDR {
+		rule := m.newRule(priority, m.config.Table)
+		rule.Src = podCIDR
+		rules = append(rules, *rule)
+		// traffic of bridge pods to eni pods goes through their veths in
+		// main, not the table of the agent
+		if eni != nil && m.config.Table != mainTable {
+			for _, ip := range eni.podIPs {
+				rule := m.newRule(priority, mainTable)
+				rule.Dst = ip
+				rules = append(rules, *rule)
+			}
+		}
+	}
+	return rules
+}
+
+func (m *Manager) newRule(priority, table int) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = priority
+	rule.Table = table
+	rule.Flow = m.config.Realm
+	return rule
+}
+
+// ensure adds the rules of desired missing, and deletes rules of the realm
+// not desired, e.g. those of a previous pod cidr. Untagged rules identical
+// to desired ones, e.g. added by previous versions, are replaced by tagged
+// ones. It returns the rules added.
+func (m *Manager) ensure(rules, desired []netlink.Rule) ([]netlink.Rule, error) {
+	want := make(map[string]bool)
+	for _, rule := range desired {
+		want[key(rule)] = true
+	}
+	owned := make(map[string]bool)
+	var legacy []netlink.Rule
+	for _, rule := range rules {
+		switch {
+		case rule.Flow == m.config.Realm && want[key(rule)]:
+			owned[key(rule)] = true
+		case rule.Flow == m.config.Realm:
+			log.Infof("iprule: delete stale rule %s", describe(rule))
+			if err := netlink.RuleDel(&rule); err != nil && !isNotFound(err) {
+				return nil, fmt.Errorf("failed to delete rule %s: %v", describe(rule), err)
+			}
+		case rule.Flow <= 0 && plain(rule) && want[key(m.tagged(rule))]:
+			legacy = append(legacy, rule)
+		}
+	}
+
+	var added []netlink.Rule
+	for _, rule := range desired {
+		if owned[key(rule)] {
+			continue
+		}
+		log.Infof("iprule: add rule %s", describe(rule))
+		if err := netlink.RuleAdd(&rule); err != nil {
+			return added, fmt.Errorf("failed to add rule %s: %v", describe(rule), err)
+		}
+		added = append(added, rule)
+	}
+	for _, rule := range legacy {
+		log.Infof("iprule: replaced untagged rule %s", describe(rule))
+		if err := netlink.RuleDel(&rule); err != nil && !isNotFound(err) {
+			return added, fmt.Errorf("failed to delete rule %s: %v", describe(rule), err)
+		}
+	}
+	return added, nil
+}
+
+// Cleanup removes every rule of the realm.
+func (m *Manager) Cleanup() error {
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	_, err = m.ensure(rules, nil)
+	return err
+}
+
+// tagged returns rule in the realm.
+func (m *Manager) tagged(rule netlink.Rule) netlink.Rule {
+	rule.Flow = m.config.Realm
+	return rule
+}
+
+// plain tells whether rule matches nothing but addresses, like the rules of
+// the agent.
+func plain(rule netlink.Rule) bool {
+	return rule.Mark < 0 && rule.Goto < 0 && rule.TunID == 0 && rule.IifName == "" && rule.OifName == "" && !rule.Invert
+}
+
+func key(rule netlink.Rule) string {
+	return fmt.Sprintf("%d/%d/%d/%v/%v", rule.Priority, rule.Table, rule.Flow, rule.Src, rule.Dst)
+}
+
+func describe(rule netlink.Rule) string {
+	src, dst := "all", "all"
+	if rule.Src != nil {
+		src = rule.Src.String()
+	}
+	if rule.Dst != nil {
+		dst = rule.Dst.String()
+	}
+	return fmt.Sprintf("pref %d from %s to %s lookup %d", rule.Priority, src, dst, rule.Table)
+}
+
+func isNotFound(err error) bool {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno == syscall.ENOENT
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package iprule
+
+import (
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ruleSubscribe sends to ch on every rule added or deleted, as netlink has
+// no RuleSubscribe. ch is closed when receiving fails, e.g. on done, and the
+// socket is closed either way.
+func ruleSubscribe(ch chan<- struct{}, done <-chan struct{}) error {
+	s, err := nl.Subscribe(unix.NETLINK_ROUTE, unix.RTNLGRP_IPV4_RULE, unix.RTNLGRP_IPV6_RULE)
+	if err != nil {
+		return err
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-stopped:
+		}
+		s.Close()
+	}()
+	go func() {
+		defer close(ch)
+		defer close(stopped)
+		for {
+			msgs, err := s.Receive()
+			if err != nil {
+				return
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case unix.RTM_NEWRULE, unix.RTM_DELRULE:
+					select {
+					case ch <- struct{}{}:
+					case <-done:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,269 @@
+// Package kmod verifies the kernel modules the bridge network relies on,
+// loading them only when they are neither loaded nor built in.
+package kmod
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	StateLoaded  = "loaded"
+	StateBuiltin = "builtin"
+	// StateLoadedNow is a module loaded by the checker.
+	StateLoadedNow = "loaded_now"
+	StateMissing   = "missing"
+	// StateUnknown is a module neither found nor loadable since modprobe is
+	// unavailable, it may still be built in.
+	StateUnknown = "unknown"
+)
+
+// probes are paths existing only if the module is available, for modules
+// built in but not listed in modules.builtin.
+var probes = map[string]string{
+	"br_netfilter": "/proc/sys/net/bridge",
+	"nf_conntrack": "/proc/sys/net/netfilter/nf_conntrack_max",
+}
+
+var moduleReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "kernel_module_ready",
+	Help:      "Whether a kernel module the agent relies on is available.",
+}, []string{"module", "required"})
+
+func init() {
+	prometheus.MustRegister(moduleReady)
+}
+
+// Module is a kernel module to verify.
+type Module struct {
+	Name string
+	// Required modules fail the readiness, the others are only reported.
+	Required bool
+}
+
+// Modules returns the modules relied on by the bridge plugin, and by the
+// portmap and bandwidth plugins if enabled.
+func Modules(portMapping, bandwidth bool) []Module {
+	modules := []Module{
+		{Name: "bridge", Required: true},
+		{Name: "veth", Required: true},
+		{Name: "br_netfilter", Required: true},
+		{Name: "nf_conntrack"},
+	}
+	if portMapping {
+		for _, name := range []string{"nf_nat", "iptable_nat", "xt_comment", "xt_mark", "xt_multiport", "xt_addrtype"} {
+			modules = append(modules, Module{Name: name})
+		}
+	}
+	if bandwidth {
+		for _, name := range []string{"ifb", "sch_tbf", "sch_ingress", "act_mirred", "cls_u32"} {
+			modules = append(modules, Module{Name: name})
+		}
+	}
+	return modules
+}
+
+// ModuleStatus is the verification result of a module.
+type ModuleStatus struct {
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is the verification result of all modules.
+type Report struct {
+	Ready   bool           `json:"ready"`
+	Modules []ModuleStatus `json:"modules"`
+}
+
+// Checker verifies kernel modules of the host, whose root is mounted at
+// hostRoot.
+type Checker struct {
+	hostRoot string
+
+	lock   sync.Mutex
+	report *Report
+}
+
+// NewChecker returns a Checker of the host whose root is mounted at
+// hostRoot, empty if the agent sees host paths directly.
+func NewChecker(hostRoot string) *Checker {
+	return &Checker{hostRoot: hostRoot}
+}
+
+func (c *Checker) hostPath(p string) string {
+	return path.Join("/", c.hostRoot, p)
+}
+
+// Check verifies modules, loading missing ones by modprobe, and returns the
+// report, which is kept for LastReport.
+func (c *Checker) Check(modules []Module) *Report {
+	loaded, err := c.loadedModules()
+	if err != nil {
+		log.Warningf("kmod: failed to read loaded modules: %v", err)
+	}
+	builtin, err := c.builtinModules()
+	if err != nil {
+		log.Warningf("kmod: failed to read built-in modules: %v", err)
+	}
+
+	report := &Report{Ready: true}
+	for _, module := range modules {
+		status := ModuleStatus{Name: module.Name, Required: module.Required}
+		name := normalize(module.Name)
+		switch {
+		case loaded[name]:
+			status.State = StateLoaded
+		case builtin[name]:
+			status.State = StateBuiltin
+		case probeExists(name):
+			// built in, but not listed, e.g. modules.builtin is not mounted
+			status.State = StateBuiltin
+		default:
+			err := c.modprobe(module.Name)
+			switch {
+			case err == nil:
+				status.State = StateLoadedNow
+			case isNotFound(err):
+				status.State = StateUnknown
+				status.Error = err.Error()
+			default:
+				status.State = StateMissing
+				status.Error = err.Error()
+			}
+		}
+
+		ready := status.State != StateMissing
+		if !ready && module.Required {
+			report.Ready = false
+		}
+		if ready {
+			moduleReady.WithLabelValues(module.Name, fmt.Sprint(module.Required)).Set(1)
+		} else {
+			moduleReady.WithLabelValues(module.Name, fmt.Sprint(module.Required)).Set(0)
+		}
+		log.Infof("kmod: module %s is %s", module.Name, status.State)
+		report.Modules = append(report.Modules, status)
+	}
+
+	c.lock.Lock()
+	c.report = report
+	c.lock.Unlock()
+	return report
+}
+
+// LastReport returns the report of the last Check, nil if not checked yet.
+func (c *Checker) LastReport() *Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.report
+}
+
+// Names returns the names of the modules in any of states, required only or
+// all.
+func (r *Report) Names(requiredOnly bool, states ...string) []string {
+	var names []string
+	for _, status := range r.Modules {
+		if requiredOnly && !status.Required {
+			continue
+		}
+		for _, state := range states {
+			if status.State == state {
+				names = append(names, status.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// loadedModules reads /proc/modules, which is not namespaced.
+func (c *Checker) loadedModules() (map[string]bool, error) {
+	file, err := os.Open("/proc/modules")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	loaded := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			loaded[normalize(fields[0])] = true
+		}
+	}
+	return loaded, scanner.Err()
+}
+
+// builtinModules reads modules.builtin of the running kernel on the host.
+func (c *Checker) builtinModules() (map[string]bool, error) {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(c.hostPath(path.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin")))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	builtin := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// e.g. kernel/net/bridge/bridge.ko
+		name := strings.TrimSuffix(path.Base(strings.TrimSpace(scanner.Text())), ".ko")
+		builtin[normalize(name)] = true
+	}
+	return builtin, scanner.Err()
+}
+
+func probeExists(name string) bool {
+	probe, ok := probes[name]
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(probe)
+	return err == nil
+}
+
+// modprobe loads module with the modules dir of the host.
+func (c *Checker) modprobe(module string) error {
+	args := []string{module}
+	if c.hostRoot != "" {
+		args = []string{"-d", c.hostPath("/"), module}
+	}
+	out, err := exec.Command("modprobe", args...).CombinedOutput()
+	if isNotFound(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("modprobe %s: %v, output %s", module, err, strings.TrimSpace(string(out)))
+	}
+	log.Infof("kmod: loaded module %s", module)
+	return nil
+}
+
+// isNotFound tells whether err is the modprobe binary not found.
+func isNotFound(err error) bool {
+	if execErr, ok := err.(*exec.Error); ok {
+		return execErr.Err == exec.ErrNotFound
+	}
+	return false
+}
+
+// normalize returns the name of a module as in /proc/modules, where dashes
+// are written as underscores.
+func normalize(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
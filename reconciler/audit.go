@@ -0,0 +1,234 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qyzhaoxun/tke-bridge-agent/events"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	auditDuplicate                = "duplicate"
+	auditAllocationWithoutSandbox = "allocation_without_sandbox"
+	auditSandboxWithoutAllocation = "sandbox_without_allocation"
+	auditPodOutsidePodCIDR        = "pod_outside_podcidr"
+)
+
+var auditIssues = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "ip_audit_issues",
+	Help:      "Number of pod ip inconsistencies found by the last audit.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(auditIssues)
+}
+
+// AuditOwner is one claim on an ip, from the host-local store, the CRI or the
+// kube api.
+type AuditOwner struct {
+	Source    string `json:"source"`
+	IP        string `json:"ip,omitempty"`
+	SandboxId string `json:"sandboxId,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+// DuplicateIP is an ip claimed by more than one sandbox or pod.
+type DuplicateIP struct {
+	IP     string       `json:"ip"`
+	Owners []AuditOwner `json:"owners"`
+}
+
+// AuditReport is the result of joining host-local allocations, CRI sandbox
+// ips and pod ips of this node.
+type AuditReport struct {
+	Time                       time.Time     `json:"time"`
+	PodCIDR                    string        `json:"podCIDR,omitempty"`
+	Duplicates                 []DuplicateIP `json:"duplicates"`
+	AllocationsWithoutSandbox  []AuditOwner  `json:"allocationsWithoutSandbox"`
+	SandboxesWithoutAllocation []AuditOwner  `json:"sandboxesWithoutAllocation"`
+	PodsOutsidePodCIDR         []AuditOwner  `json:"podsOutsidePodCIDR"`
+	Errors                     []string      `json:"errors,omitempty"`
+}
+
+const (
+	sourceHostLocal = "host-local"
+	sourceCRI       = "cri"
+	sourcePod       = "pod"
+)
+
+// audit joins all views of pod ips of this node, and reports the
+// inconsistencies as metrics, events and the report served by ServeAudit.
+func (cr *CniReconciler) audit() {
+	log.Infof("cniReconciler: start auditing pod ips")
+	report := &AuditReport{Time: time.Now()}
+	podCIDR := cr.getPodCIDR()
+	if podCIDR != nil {
+		report.PodCIDR = podCIDR.String()
+	}
+
+	owners := make(map[string][]AuditOwner)
+
+	allocInfo, err := cr.getAllocateSet()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to get cni allocated info: %v", err))
+	}
+	allocatedIds := make(map[string]bool)
+	for ip, alloc := range allocInfo {
+		owners[ip] = append(owners[ip], AuditOwner{Source: sourceHostLocal, IP: ip, SandboxId: alloc.containerId})
+		allocatedIds[alloc.containerId] = true
+	}
+
+	sandboxes, err := cr.criClient.GetReadyPodSandboxes()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list ready sandboxes: %v", err))
+	}
+	readyIds := make(map[string]bool)
+	for _, sandbox := range sandboxes {
+		readyIds[sandbox.ContainerId] = true
+		status, err := cr.criClient.GetPodSandboxStatus(sandbox.ContainerId)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to get status of sandbox %s: %v", sandbox.ContainerId, err))
+			continue
+		}
+		if status.HostNetwork {
+			continue
+		}
+		pod := fmt.Sprintf("%s/%s", sandbox.NameSpace, sandbox.PodName)
+		for _, ip := range status.IPs {
+			owner := AuditOwner{Source: sourceCRI, IP: ip, SandboxId: sandbox.ContainerId, Pod: pod}
+			owners[ip] = append(owners[ip], owner)
+			// sandboxes of other networks, e.g. eni pods, are not allocated by tke-bridge
+			if podCIDR != nil && podCIDR.Contains(net.ParseIP(ip)) && !allocatedIds[sandbox.ContainerId] {
+				report.SandboxesWithoutAllocation = append(report.SandboxesWithoutAllocation, owner)
+			}
+		}
+	}
+
+	if sandboxes != nil {
+		for ip, alloc := range allocInfo {
+			if !readyIds[alloc.containerId] {
+				report.AllocationsWithoutSandbox = append(report.AllocationsWithoutSandbox,
+					AuditOwner{Source: sourceHostLocal, IP: ip, SandboxId: alloc.containerId})
+			}
+		}
+	}
+
+	pods := make(map[string]*v1.Pod)
+	if cr.podStore != nil {
+		if cr.podsSynced() {
+			for _, obj := range cr.podStore.List() {
+				pod, ok := obj.(*v1.Pod)
+				if !ok || pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+					continue
+				}
+				if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+					continue
+				}
+				key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+				pods[key] = pod
+				owner := AuditOwner{Source: sourcePod, IP: pod.Status.PodIP, Pod: key}
+				owners[pod.Status.PodIP] = append(owners[pod.Status.PodIP], owner)
+				if podCIDR != nil && !podCIDR.Contains(net.ParseIP(pod.Status.PodIP)) {
+					report.PodsOutsidePodCIDR = append(report.PodsOutsidePodCIDR, owner)
+				}
+			}
+		} else {
+			report.Errors = append(report.Errors, "pods not synced")
+		}
+	}
+
+	for ip, ipOwners := range owners {
+		sandboxIds := make(map[string]bool)
+		podNames := make(map[string]bool)
+		for _, owner := range ipOwners {
+			if owner.SandboxId != "" {
+				sandboxIds[owner.SandboxId] = true
+			}
+			if owner.Pod != "" {
+				podNames[owner.Pod] = true
+			}
+		}
+		if len(sandboxIds) > 1 || len(podNames) > 1 {
+			report.Duplicates = append(report.Duplicates, DuplicateIP{IP: ip, Owners: ipOwners})
+		}
+	}
+	report.sort()
+
+	cr.reportAudit(report, pods)
+	log.Infof("cniReconciler: audit over, %d duplicates, %d allocations without sandbox, %d sandboxes without allocation, %d pods outside pod cidr, %d errors",
+		len(report.Duplicates), len(report.AllocationsWithoutSandbox), len(report.SandboxesWithoutAllocation),
+		len(report.PodsOutsidePodCIDR), len(report.Errors))
+}
+
+func (r *AuditReport) sort() {
+	sort.Slice(r.Duplicates, func(i, j int) bool { return r.Duplicates[i].IP < r.Duplicates[j].IP })
+	for _, owners := range [][]AuditOwner{r.AllocationsWithoutSandbox, r.SandboxesWithoutAllocation, r.PodsOutsidePodCIDR} {
+		sort.Slice(owners, func(i, j int) bool { return owners[i].IP < owners[j].IP })
+	}
+}
+
+func (cr *CniReconciler) reportAudit(report *AuditReport, pods map[string]*v1.Pod) {
+	auditIssues.WithLabelValues(auditDuplicate).Set(float64(len(report.Duplicates)))
+	auditIssues.WithLabelValues(auditAllocationWithoutSandbox).Set(float64(len(report.AllocationsWithoutSandbox)))
+	auditIssues.WithLabelValues(auditSandboxWithoutAllocation).Set(float64(len(report.SandboxesWithoutAllocation)))
+	auditIssues.WithLabelValues(auditPodOutsidePodCIDR).Set(float64(len(report.PodsOutsidePodCIDR)))
+
+	cr.auditLock.Lock()
+	cr.auditReport = report
+	cr.auditLock.Unlock()
+
+	if cr.recorder == nil {
+		return
+	}
+	node := events.NodeReference(cr.nodeName)
+	for _, dup := range report.Duplicates {
+		cr.recorder.Eventf(node, v1.EventTypeWarning, "DuplicatePodIP", "ip %s is claimed by %v", dup.IP, dup.Owners)
+		for _, owner := range dup.Owners {
+			if pod, ok := pods[owner.Pod]; ok {
+				cr.recorder.Eventf(events.PodReference(pod.Namespace, pod.Name, pod.UID), v1.EventTypeWarning,
+					"DuplicatePodIP", "ip %s is claimed by %v", dup.IP, dup.Owners)
+			}
+		}
+	}
+	for _, owner := range report.AllocationsWithoutSandbox {
+		cr.recorder.Eventf(node, v1.EventTypeWarning, "IPAllocationWithoutSandbox",
+			"ip %s is allocated to pod sandbox %s which is not running", owner.IP, owner.SandboxId)
+	}
+	for _, owner := range report.SandboxesWithoutAllocation {
+		cr.recorder.Eventf(node, v1.EventTypeWarning, "SandboxWithoutIPAllocation",
+			"pod sandbox %s of %s uses ip %s which is not allocated to it", owner.SandboxId, owner.Pod, owner.IP)
+	}
+	for _, owner := range report.PodsOutsidePodCIDR {
+		if pod, ok := pods[owner.Pod]; ok {
+			cr.recorder.Eventf(events.PodReference(pod.Namespace, pod.Name, pod.UID), v1.EventTypeWarning,
+				"PodIPOutsidePodCIDR", "pod ip %s is outside pod cidr %s", owner.IP, report.PodCIDR)
+		}
+	}
+}
+
+// ServeAudit serves the last audit report as json.
+func (cr *CniReconciler) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	cr.auditLock.Lock()
+	report := cr.auditReport
+	cr.auditLock.Unlock()
+
+	if report == nil {
+		http.Error(w, "no audit report yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Errorf("cniReconciler: failed to encode audit report: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/containernetworking/cni/libcni"
+	log "github.com/golang/glog"
+)
+
+const (
+	// DefaultCNIResultsDir is where libcni caches the results of ADD.
+	DefaultCNIResultsDir = "/var/lib/cni/results"
+	defaultIfName        = "eth0"
+
+	// cniCacheV1 is the kind libcni (>= 0.8) writes into its result cache,
+	// older versions store the bare result instead.
+	cniCacheV1 = "cniCacheV1"
+)
+
+// gcPath records how a stale allocation has been released.
+type gcPath string
+
+const (
+	// gcPathCNIDel means the whole tke-bridge conflist was invoked with DEL.
+	gcPathCNIDel gcPath = "cni-del"
+	// gcPathFileRemove means only the host-local ip files were removed.
+	gcPathFileRemove gcPath = "file-remove"
+)
+
+// allocation identifies the owner of a host-local ip file.
+type allocation struct {
+	containerId string
+	ifName      string
+}
+
+func (a allocation) String() string {
+	return fmt.Sprintf("%s/%s", a.containerId, a.ifName)
+}
+
+// cachedResult is what libcni cached for a (network, containerID, ifname) on ADD.
+type cachedResult struct {
+	result         map[string]interface{}
+	capabilityArgs map[string]interface{}
+}
+
+// loadCachedResult reads the libcni result cache of an allocation, returns nil
+// if the runtime did not cache anything.
+func (cr *CniReconciler) loadCachedResult(netName string, alloc allocation) *cachedResult {
+	file := path.Join(cr.cniResultsDir, fmt.Sprintf("%s-%s-%s", netName, alloc.containerId, alloc.ifName))
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("cniReconciler: failed to read cached result %s: %v", file, err)
+		}
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.Warningf("cniReconciler: failed to parse cached result %s: %v", file, err)
+		return nil
+	}
+
+	if kind, _ := raw["kind"].(string); kind != cniCacheV1 {
+		return &cachedResult{result: raw}
+	}
+	cached := &cachedResult{}
+	cached.result, _ = raw["result"].(map[string]interface{})
+	cached.capabilityArgs, _ = raw["capabilityArgs"].(map[string]interface{})
+	return cached
+}
+
+// cniDel invokes the tke-bridge conflist with DEL for the allocation so that
+// every plugin (bridge/host-local, bandwidth, portmap) releases its resources.
+func (cr *CniReconciler) cniDel(alloc allocation) error {
+	list, err := libcni.ConfListFromFile(cr.cniConfFile)
+	if err != nil {
+		return fmt.Errorf("failed to load cni conflist %s: %v", cr.cniConfFile, err)
+	}
+
+	rt := &libcni.RuntimeConf{
+		ContainerID: alloc.containerId,
+		IfName:      alloc.ifName,
+	}
+
+	if cached := cr.loadCachedResult(list.Name, alloc); cached != nil {
+		log.Infof("cniReconciler: using cached result of %v for cni DEL", alloc)
+		rt.CapabilityArgs = cached.capabilityArgs
+		if cached.result != nil {
+			list, err = injectPrevResult(list, cached.result)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cniConfig := &libcni.CNIConfig{Path: cr.cniBinDirs}
+	return cniConfig.DelNetworkList(list, rt)
+}
+
+// injectPrevResult returns a copy of list whose plugins carry prevResult.
+func injectPrevResult(list *libcni.NetworkConfigList, prevResult map[string]interface{}) (*libcni.NetworkConfigList, error) {
+	injected := *list
+	injected.Plugins = make([]*libcni.NetworkConfig, 0, len(list.Plugins))
+	for _, plugin := range list.Plugins {
+		conf, err := libcni.InjectConf(plugin, map[string]interface{}{"prevResult": prevResult})
+		if err != nil {
+			return nil, fmt.Errorf("failed to inject prevResult into %s: %v", plugin.Network.Type, err)
+		}
+		injected.Plugins = append(injected.Plugins, conf)
+	}
+	return &injected, nil
+}
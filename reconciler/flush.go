@@ -0,0 +1,133 @@
+package reconciler
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	conntrackFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "released_ip_conntrack_flushed_total",
+		Help:      "Number of conntrack entries deleted for released pod ips.",
+	})
+	neighborsFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "released_ip_neighbors_flushed_total",
+		Help:      "Number of neighbor entries on the bridge deleted for released pod ips.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(conntrackFlushed, neighborsFlushed)
+}
+
+// ipConntrackFilter matches flows having ip on any side of either direction,
+// i.e. flows from or to the pod and flows NATed to it, e.g. by portmap.
+type ipConntrackFilter struct {
+	ip net.IP
+}
+
+func (f ipConntrackFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	return f.ip.Equal(flow.Forward.SrcIP) || f.ip.Equal(flow.Forward.DstIP) ||
+		f.ip.Equal(flow.Reverse.SrcIP) || f.ip.Equal(flow.Reverse.DstIP)
+}
+
+// flushReleasedIPs deletes conntrack entries and neighbor entries on the
+// bridge of released ips, so that the next pod getting one of them does not
+// receive traffic meant for the previous one.
+func (cr *CniReconciler) flushReleasedIPs(ips []string) {
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		// the ip may have been allocated to a new pod right after released,
+		// whose connections must be kept
+		if _, err := os.Stat(filepath.Join(cr.allocateInfoPath, ipStr)); err == nil {
+			log.Infof("cniReconciler: ip %s is allocated again, skip flushing it", ipStr)
+			continue
+		}
+		cr.flushConntrack(ip)
+		cr.flushNeighbor(ip)
+	}
+}
+
+func (cr *CniReconciler) flushConntrack(ip net.IP) {
+	family := netlink.InetFamily(netlink.FAMILY_V4)
+	if ip.To4() == nil {
+		family = netlink.InetFamily(netlink.FAMILY_V6)
+	}
+	n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, ipConntrackFilter{ip: ip})
+	if err != nil {
+		log.Warningf("cniReconciler: failed to delete conntrack entries of %s: %v", ip, err)
+		return
+	}
+	if n > 0 {
+		log.Infof("cniReconciler: deleted %d conntrack entries of %s", n, ip)
+		conntrackFlushed.Add(float64(n))
+	}
+}
+
+func (cr *CniReconciler) flushNeighbor(ip net.IP) {
+	if cr.bridgeName == "" {
+		return
+	}
+	bridge, err := netlink.LinkByName(cr.bridgeName)
+	if err != nil {
+		log.V(4).Infof("cniReconciler: bridge %s not found, skip flushing neighbor of %s: %v", cr.bridgeName, ip, err)
+		return
+	}
+	neighs, err := netlink.NeighList(bridge.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		log.Warningf("cniReconciler: failed to list neighbors on %s: %v", cr.bridgeName, err)
+		return
+	}
+	for i := range neighs {
+		if !neighs[i].IP.Equal(ip) {
+			continue
+		}
+		if err := netlink.NeighDel(&neighs[i]); err != nil {
+			log.Warningf("cniReconciler: failed to delete neighbor %s on %s: %v", ip, cr.bridgeName, err)
+			continue
+		}
+		log.Infof("cniReconciler: deleted neighbor %s(%s) on %s", ip, neighs[i].HardwareAddr, cr.bridgeName)
+		neighborsFlushed.Inc()
+	}
+}
+
+// checkReleasedIPs flushes ips which have left the host-local store since the
+// last check, i.e. released by cni DEL from the kubelet rather than by the
+// reconciler.
+func (cr *CniReconciler) checkReleasedIPs() {
+	allocInfo, err := cr.getAllocateSet()
+	if err != nil {
+		log.V(4).Infof("cniReconciler: failed to get cni allocated info: %v", err)
+		return
+	}
+
+	last := cr.allocatedIPs
+	cr.allocatedIPs = make(map[string]bool, len(allocInfo))
+	for ip := range allocInfo {
+		cr.allocatedIPs[ip] = true
+	}
+	if last == nil {
+		return
+	}
+
+	var released []string
+	for ip := range last {
+		if !cr.allocatedIPs[ip] {
+			released = append(released, ip)
+		}
+	}
+	if len(released) > 0 {
+		log.Infof("cniReconciler: find ips %v released from store, flush them", released)
+		cr.flushReleasedIPs(released)
+	}
+}
@@ -0,0 +1,118 @@
+package reconciler
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultPodGracePeriod is how old an ip file must be before it is
+	// released, sandboxes get ready and pods get their ip reported in status
+	// some time after cni ADD.
+	DefaultPodGracePeriod = 5 * time.Minute
+)
+
+// podIPs returns the ips used by running pods of this node, keyed by ip. ok
+// is false if the pod store is not available.
+func (cr *CniReconciler) podIPs() (ips map[string]string, ok bool) {
+	if cr.podStore == nil || cr.podsSynced == nil || !cr.podsSynced() {
+		return nil, false
+	}
+
+	ips = make(map[string]string)
+	for _, obj := range cr.podStore.List() {
+		pod, isPod := obj.(*v1.Pod)
+		if !isPod || pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+			continue
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		ips[pod.Status.PodIP] = fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+	}
+	return ips, true
+}
+
+// crossCheck drops allocations which the CRI considers dirty but are still
+// used by running pods according to the kube api, and reports the
+// disagreement instead of releasing them.
+func (cr *CniReconciler) crossCheck(dirty map[allocation][]string) map[allocation][]string {
+	if !cr.podCrossCheck {
+		return dirty
+	}
+	podIPs, ok := cr.podIPs()
+	if !ok {
+		log.Warningf("cniReconciler: pods not synced, skip cross-checking with kube api")
+		return dirty
+	}
+
+	checked := make(map[allocation][]string, len(dirty))
+	for alloc, ips := range dirty {
+		agreed := true
+		for _, ip := range ips {
+			if pod, used := podIPs[ip]; used {
+				log.Warningf("cniReconciler: CRI and kube api disagree, ip %s of pod sandbox(%s) not ready in CRI is used by running pod %s, refuse to release it",
+					ip, alloc.containerId, pod)
+				agreed = false
+			}
+		}
+		if agreed {
+			checked[alloc] = ips
+		}
+	}
+	return checked
+}
+
+// checkDirtyCNIDataByPods releases ips which are clearly dead according to the
+// kube api, i.e. not used by any running pod of this node and allocated long
+// enough ago. It is used when the CRI is unreachable.
+func (cr *CniReconciler) checkDirtyCNIDataByPods() {
+	podIPs, ok := cr.podIPs()
+	if !ok {
+		log.Errorf("cniReconciler: pods not synced, skip checking")
+		return
+	}
+
+	allocInfo, err := cr.getAllocateSet()
+	if err != nil {
+		log.Errorf("failed to get cni allocated info, skip checking: %v", err)
+		return
+	}
+	log.Infof("get allocated info: %v", allocInfo)
+
+	dirty := make(map[allocation][]string)
+	for ip, alloc := range allocInfo {
+		if _, used := podIPs[ip]; used {
+			continue
+		}
+		if cr.inGracePeriod(ip) {
+			continue
+		}
+		log.Infof("cniReconciler: find ip %s allocated to pod sandbox(%s) not used by any running pod, delete it from store",
+			ip, alloc.containerId)
+		dirty[alloc] = append(dirty[alloc], ip)
+	}
+
+	cr.releaseDirty(dirty)
+}
+
+// inGracePeriod tells whether the ip file of ip was written less than the pod
+// grace period ago, e.g. by a cni ADD of a sandbox not ready yet, in which
+// case the ip must not be released.
+func (cr *CniReconciler) inGracePeriod(ip string) bool {
+	fi, err := os.Stat(fmt.Sprintf("%s/%s", cr.allocateInfoPath, ip))
+	if err != nil {
+		log.Errorf("cniReconciler: failed to stat ip file %s: %v", ip, err)
+		return true
+	}
+	if age := time.Since(fi.ModTime()); age < cr.podGracePeriod {
+		log.V(4).Infof("cniReconciler: ip %s allocated %v ago, skip it", ip, age)
+		return true
+	}
+	return false
+}
@@ -8,51 +8,206 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
-	defaultCheckInterval = 5 * time.Minute
+	DefaultCheckInterval       = 5 * time.Minute
+	DefaultSandboxPollInterval = 10 * time.Second
 )
 
+// Config holds the settings of a CniReconciler.
+type Config struct {
+	// AllocateInfoPath is the host-local store dir of tke-bridge.
+	AllocateInfoPath string
+	// CniConfFile is the conflist invoked with DEL to release leaked ips.
+	CniConfFile string
+	// CniBinDir is where the plugins of CniConfFile located.
+	CniBinDir string
+	// CNIResultsDir is the libcni result cache, whose results are passed to
+	// DEL as prevResult.
+	CNIResultsDir string
+	// CRIClient lists sandboxes from the container runtime.
+	CRIClient cri.CRIAPIs
+	// CheckInterval is the interval of full reconciliation.
+	CheckInterval time.Duration
+	// SandboxPollInterval is the interval of diffing ready sandboxes to
+	// release ips of removed ones, 0 disables it.
+	SandboxPollInterval time.Duration
+	// PodStore holds the pods of this node, used by cross-checking and
+	// auditing.
+	PodStore   cache.Store
+	PodsSynced cache.InformerSynced
+	// PodCrossCheck enables refusing to release ips the kube api still sees
+	// in use, and using the kube api as the truth source when the CRI is
+	// unreachable.
+	PodCrossCheck bool
+	// PodGracePeriod is how old an ip file must be before it is released,
+	// so that sandboxes being set up are not torn down.
+	PodGracePeriod time.Duration
+	// Audit enables auditing pod ips before every full reconciliation.
+	Audit bool
+	// BridgeName is the bridge whose stale veth ports are removed.
+	BridgeName string
+	// VethGCGracePeriod is how long a veth on the bridge must stay orphaned
+	// before being removed, 0 disables removing stale veths.
+	VethGCGracePeriod time.Duration
+	// FlushCNIReleasedIPs enables flushing conntrack and neighbor entries of
+	// ips released by cni DEL of the kubelet, detected on every sandbox poll.
+	// ips released by the reconciler itself are always flushed.
+	FlushCNIReleasedIPs bool
+	// NodeName and Recorder are used to report audit findings as events.
+	NodeName string
+	Recorder record.EventRecorder
+}
+
 type CniReconciler struct {
-	allocateInfoPath string
-	criClient        cri.CRIAPIs
+	allocateInfoPath    string
+	cniConfFile         string
+	cniBinDirs          []string
+	cniResultsDir       string
+	checkInterval       time.Duration
+	sandboxPollInterval time.Duration
+	criClient           cri.CRIAPIs
+	podStore            cache.Store
+	podsSynced          cache.InformerSynced
+	podCrossCheck       bool
+	podGracePeriod      time.Duration
+	auditEnabled        bool
+	nodeName            string
+	recorder            record.EventRecorder
+	bridgeName          string
+	vethGCGracePeriod   time.Duration
+	flushCNIReleased    bool
+
+	podCIDRLock sync.Mutex
+	podCIDR     *net.IPNet
+
+	auditLock   sync.Mutex
+	auditReport *AuditReport
+
+	// orphanVeths is the bridge ports not belonging to live sandboxes, keyed
+	// by ifindex
+	orphanVeths map[int]*orphanVeth
+
+	// readySandboxes is the ready sandboxes seen by the last listing
+	readySandboxes map[string]*cri.SandboxInfo
+
+	// allocatedIPs is the ips in the host-local store seen by the last check
+	// of released ips
+	allocatedIPs map[string]bool
 }
 
-func New(allocateInfoPath string) *CniReconciler {
-	if allocateInfoPath == "" {
-		allocateInfoPath = "/var/lib/cni/networks/tke-bridge"
+// New returns a reconciler which releases ips held by dead sandboxes by
+// invoking the cni conflist with DEL.
+func New(config Config) *CniReconciler {
+	if config.AllocateInfoPath == "" {
+		config.AllocateInfoPath = "/var/lib/cni/networks/tke-bridge"
+	}
+	if config.CNIResultsDir == "" {
+		config.CNIResultsDir = DefaultCNIResultsDir
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	if config.PodGracePeriod <= 0 {
+		config.PodGracePeriod = DefaultPodGracePeriod
 	}
 	return &CniReconciler{
-		allocateInfoPath: allocateInfoPath,
-		criClient:        cri.New(),
+		allocateInfoPath:    config.AllocateInfoPath,
+		cniConfFile:         config.CniConfFile,
+		cniBinDirs:          []string{config.CniBinDir},
+		cniResultsDir:       config.CNIResultsDir,
+		checkInterval:       config.CheckInterval,
+		sandboxPollInterval: config.SandboxPollInterval,
+		criClient:           config.CRIClient,
+		podStore:            config.PodStore,
+		podCrossCheck:       config.PodCrossCheck && config.PodStore != nil,
+		podsSynced:          config.PodsSynced,
+		podGracePeriod:      config.PodGracePeriod,
+		auditEnabled:        config.Audit,
+		nodeName:            config.NodeName,
+		recorder:            config.Recorder,
+		bridgeName:          config.BridgeName,
+		vethGCGracePeriod:   config.VethGCGracePeriod,
+		flushCNIReleased:    config.FlushCNIReleasedIPs,
+		orphanVeths:         make(map[int]*orphanVeth),
 	}
 }
 
+// SetPodCIDR updates the pod cidr of this node.
+func (cr *CniReconciler) SetPodCIDR(cidr *net.IPNet) {
+	cr.podCIDRLock.Lock()
+	defer cr.podCIDRLock.Unlock()
+	cr.podCIDR = cidr
+}
+
+func (cr *CniReconciler) getPodCIDR() *net.IPNet {
+	cr.podCIDRLock.Lock()
+	defer cr.podCIDRLock.Unlock()
+	return cr.podCIDR
+}
+
 func (cr *CniReconciler) Run(stopCh <-chan struct{}) {
 	// check dirty cni at startup
-	cr.checkDirtyCNIData()
+	cr.reconcile()
+
+	ticker := time.NewTicker(cr.checkInterval)
+	defer ticker.Stop()
+
+	var pollCh <-chan time.Time
+	if cr.sandboxPollInterval > 0 {
+		poller := time.NewTicker(cr.sandboxPollInterval)
+		defer poller.Stop()
+		pollCh = poller.C
+	}
 
-	ticker := time.NewTicker(defaultCheckInterval)
 	for {
 		select {
 		case <-ticker.C:
-			cr.checkDirtyCNIData()
+			cr.reconcile()
+		case <-pollCh:
+			cr.checkRemovedSandboxes()
+			if cr.flushCNIReleased {
+				cr.checkReleasedIPs()
+			}
 		case <-stopCh:
 			return
 		}
 	}
 }
 
+func (cr *CniReconciler) reconcile() {
+	// audit before releasing, so that the report shows the allocations
+	// without sandboxes the release is about to free
+	if cr.auditEnabled {
+		cr.audit()
+	}
+	cr.checkDirtyCNIData()
+	if cr.vethGCGracePeriod > 0 && cr.bridgeName != "" {
+		cr.checkStaleVeths()
+	}
+}
+
 func (cr *CniReconciler) checkDirtyCNIData() {
 	log.Infof("start checking if ipam store has dirty cni data in dir: %s==========================>", cr.allocateInfoPath)
 
-	sandboxes, err := cr.criClient.GetReadyPodSandboxes()
+	sandboxesSet, err := cr.listReadySandboxes()
 	if err != nil {
-		log.Errorf("failed to list ready sandboxes, skip checking: %v", err)
+		if !cr.podCrossCheck {
+			log.Errorf("failed to list ready sandboxes, skip checking: %v", err)
+			return
+		}
+		log.Warningf("failed to list ready sandboxes, checking with pods from kube api: %v", err)
+		cr.checkDirtyCNIDataByPods()
+		log.Infof("check over ===============================================================>")
 		return
 	}
+	log.Infof("get ready sandboxesSet: %v", sandboxesSet)
 
 	allocInfo, err := cr.getAllocateSet()
 	if err != nil {
@@ -61,38 +216,66 @@ func (cr *CniReconciler) checkDirtyCNIData() {
 	}
 	log.Infof("get allocated info: %v", allocInfo)
 
+	// group dirty ips by owner, so that cni DEL runs once per (containerID, ifname)
+	dirty := make(map[allocation][]string)
+	for ip, alloc := range allocInfo {
+		if _, ok := sandboxesSet[alloc.containerId]; ok {
+			continue
+		}
+		// a sandbox not ready may be being set up, which DEL would tear down
+		if cr.inGracePeriod(ip) {
+			continue
+		}
+		if alloc.containerId == "" {
+			log.Infof("cniReconciler: find ip %s allocated to nothing, delete it from store", ip)
+		} else {
+			log.Infof("cniReconciler: find ip %s allocated to pod sandbox(%s) not running, delete it from store",
+				ip, alloc.containerId)
+		}
+		dirty[alloc] = append(dirty[alloc], ip)
+	}
+
+	cr.releaseDirty(cr.crossCheck(dirty))
+	log.Infof("check over ===============================================================>")
+}
+
+// listReadySandboxes lists ready sandboxes from the CRI and remembers them
+// for the next diff.
+func (cr *CniReconciler) listReadySandboxes() (map[string]*cri.SandboxInfo, error) {
+	sandboxes, err := cr.criClient.GetReadyPodSandboxes()
+	if err != nil {
+		return nil, err
+	}
+
 	sandboxesSet := make(map[string]*cri.SandboxInfo)
 	for _, sandbox := range sandboxes {
 		sandboxesSet[sandbox.ContainerId] = sandbox
 	}
-	log.Infof("get ready sandboxesSet: %v", sandboxesSet)
+	cr.readySandboxes = sandboxesSet
+	return sandboxesSet, nil
+}
 
-	for ip, containerId := range allocInfo {
-		if containerId == "" {
-			log.Infof("cniReconciler: find ip %s allocated to nothing, delete it from store", ip)
-			if err = cr.handleCNIDelete(ip); err != nil {
-				// not return, continue to deal with next data
-				log.Errorf("cniReconciler: failed to delete dirty ip %v allocated info: %v", ip, err)
-			} else {
-				log.Infof("cniReconciler: succeed to delete dirty ip %v allocated info", ip)
-			}
-		}
-		if _, ok := sandboxesSet[containerId]; !ok {
-			log.Infof("cniReconciler: find ip %s allocated to pod sandbox(%s) not running, delete it from store",
-				ip, containerId)
-			if err = cr.handleCNIDelete(ip); err != nil {
-				// not return, continue to deal with next data
-				log.Errorf("cniReconciler: failed to delete dirty ip %v allocated info: %v", ip, err)
-			} else {
-				log.Infof("cniReconciler: succeed to delete dirty ip %v allocated info", ip)
-			}
+// releaseDirty releases every dirty allocation and logs which path was taken.
+func (cr *CniReconciler) releaseDirty(dirty map[allocation][]string) {
+	released := make(map[gcPath]int)
+	for alloc, ips := range dirty {
+		path, err := cr.handleCNIDelete(alloc, ips)
+		if err != nil {
+			// not return, continue to deal with next data
+			log.Errorf("cniReconciler: failed to delete dirty ips %v allocated info: %v", ips, err)
+			continue
 		}
+		log.Infof("cniReconciler: succeed to delete dirty ips %v of %v via %s", ips, alloc, path)
+		released[path] += len(ips)
+		cr.flushReleasedIPs(ips)
 	}
-	log.Infof("check over ===============================================================>")
+	log.Infof("cniReconciler: released %d ips via %s, %d ips via %s",
+		released[gcPathCNIDel], gcPathCNIDel, released[gcPathFileRemove], gcPathFileRemove)
 }
 
-func (cr *CniReconciler) getAllocateSet() (map[string]string, error) {
-	res := make(map[string]string)
+// getAllocateSet returns the owner of every ip in the host-local store.
+func (cr *CniReconciler) getAllocateSet() (map[string]allocation, error) {
+	res := make(map[string]allocation)
 	dir, err := ioutil.ReadDir(cr.allocateInfoPath)
 	if err != nil {
 		return nil, err
@@ -103,24 +286,42 @@ func (cr *CniReconciler) getAllocateSet() (map[string]string, error) {
 			if ip != nil {
 				file, err := os.Open(fmt.Sprintf("%s/%s", cr.allocateInfoPath, fi.Name()))
 				if err != nil {
-					log.Error("failed to open file %s", fi.Name())
+					log.Errorf("failed to open file %s", fi.Name())
 					continue
 				}
-				// 获取第一行的containerId即可
+				// 第一行为containerId，新版本host-local第二行为ifname
 				scanner := bufio.NewScanner(file)
-				var containerId string
-				for scanner.Scan() {
-					containerId = scanner.Text()
-					break
+				alloc := allocation{ifName: defaultIfName}
+				if scanner.Scan() {
+					alloc.containerId = scanner.Text()
+				}
+				if scanner.Scan() && scanner.Text() != "" {
+					alloc.ifName = scanner.Text()
 				}
 				file.Close()
-				res[fi.Name()] = containerId
+				res[fi.Name()] = alloc
 			}
 		}
 	}
 	return res, nil
 }
 
-func (cr *CniReconciler) handleCNIDelete(ip string) error {
-	return os.Remove(fmt.Sprintf("%s/%s", cr.allocateInfoPath, ip))
+// handleCNIDelete releases ips of alloc by cni DEL, and falls back to removing
+// the ip files if DEL fails. It returns which path released the ips.
+func (cr *CniReconciler) handleCNIDelete(alloc allocation, ips []string) (gcPath, error) {
+	if alloc.containerId != "" {
+		err := cr.cniDel(alloc)
+		if err == nil {
+			return gcPathCNIDel, nil
+		}
+		log.Warningf("cniReconciler: cni DEL for %v failed, fall back to remove ip files: %v", alloc, err)
+	}
+
+	for _, ip := range ips {
+		err := os.Remove(fmt.Sprintf("%s/%s", cr.allocateInfoPath, ip))
+		if err != nil && !os.IsNotExist(err) {
+			return gcPathFileRemove, err
+		}
+	}
+	return gcPathFileRemove, nil
 }
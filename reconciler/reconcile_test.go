@@ -0,0 +1,271 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/qyzhaoxun/tke-bridge-agent/cri"
+	"github.com/qyzhaoxun/tke-bridge-agent/cri/fake"
+)
+
+// fakePlugin records the stdin of every invocation into $FAKE_PLUGIN_LOG, and
+// releases the ips of the container in $FAKE_IPAM_DIR like host-local.
+const fakePlugin = `#!/bin/sh
+cat > "$FAKE_PLUGIN_LOG/$CNI_COMMAND-$CNI_CONTAINERID"
+for f in "$FAKE_IPAM_DIR"/*; do
+	[ "$(head -n 1 "$f")" = "$CNI_CONTAINERID" ] && rm -f "$f"
+done
+exit 0
+`
+
+const fakeConfList = `{
+  "cniVersion": "0.3.1",
+  "name": "tke-bridge",
+  "plugins": [{"type": "fake-bridge"}]
+}`
+
+type testEnv struct {
+	runtime *fake.Runtime
+	client  *cri.CRIClient
+	dir     string
+	// env is the previous value of the environment variables set
+	env map[string]*string
+	// ipamDir is the host-local store, logDir the invocations of the plugin
+	ipamDir    string
+	logDir     string
+	resultsDir string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "reconciler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &testEnv{
+		dir:        dir,
+		ipamDir:    path.Join(dir, "networks", "tke-bridge"),
+		logDir:     path.Join(dir, "log"),
+		resultsDir: path.Join(dir, "results"),
+		env:        make(map[string]*string),
+	}
+	for _, d := range []string{env.ipamDir, env.logDir, env.resultsDir, path.Join(dir, "bin")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, path.Join(dir, "bin", "fake-bridge"), fakePlugin, 0755)
+	writeFile(t, path.Join(dir, "tke-bridge.conflist"), fakeConfList, 0644)
+	env.setenv("FAKE_PLUGIN_LOG", env.logDir)
+	env.setenv("FAKE_IPAM_DIR", env.ipamDir)
+
+	env.runtime, err = fake.NewRuntime()
+	if err != nil {
+		t.Fatalf("failed to start fake runtime: %v", err)
+	}
+	env.client = cri.New([]string{env.runtime.Endpoint}, "")
+	return env
+}
+
+// setenv sets key to value until cleanup.
+func (env *testEnv) setenv(key, value string) {
+	if _, saved := env.env[key]; !saved {
+		if old, ok := os.LookupEnv(key); ok {
+			env.env[key] = &old
+		} else {
+			env.env[key] = nil
+		}
+	}
+	os.Setenv(key, value)
+}
+
+func (env *testEnv) cleanup() {
+	env.client.Close()
+	env.runtime.Stop()
+	os.RemoveAll(env.dir)
+	for key, old := range env.env {
+		if old == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *old)
+		}
+	}
+}
+
+func (env *testEnv) reconciler() *CniReconciler {
+	return New(Config{
+		AllocateInfoPath: env.ipamDir,
+		CniConfFile:      path.Join(env.dir, "tke-bridge.conflist"),
+		CniBinDir:        path.Join(env.dir, "bin"),
+		CNIResultsDir:    env.resultsDir,
+		CRIClient:        env.client,
+	})
+}
+
+// allocate writes the host-local ip file of ip owned by containerID,
+// allocated before the pod grace period.
+func (env *testEnv) allocate(t *testing.T, ip, containerID string) {
+	env.allocateAt(t, ip, containerID, time.Now().Add(-2*DefaultPodGracePeriod))
+}
+
+func (env *testEnv) allocateAt(t *testing.T, ip, containerID string, mtime time.Time) {
+	content := ""
+	if containerID != "" {
+		content = containerID + "\n" + defaultIfName
+	}
+	file := path.Join(env.ipamDir, ip)
+	writeFile(t, file, content, 0644)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (env *testEnv) allocated(ip string) bool {
+	_, err := os.Stat(path.Join(env.ipamDir, ip))
+	return err == nil
+}
+
+// invocation returns the config the plugin got for command of containerID,
+// nil if not invoked.
+func (env *testEnv) invocation(t *testing.T, command, containerID string) map[string]interface{} {
+	data, err := ioutil.ReadFile(path.Join(env.logDir, command+"-"+containerID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		t.Fatalf("invalid config passed to plugin: %v: %s", err, data)
+	}
+	return conf
+}
+
+func writeFile(t *testing.T, file, content string, mode os.FileMode) {
+	if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDirtyCNIData(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	env.runtime.SetSandbox(fake.Sandbox{Id: "live", Name: "live", Namespace: "default", Ready: true})
+	env.runtime.SetSandbox(fake.Sandbox{Id: "stopped", Name: "stopped", Namespace: "default"})
+	env.allocate(t, "172.16.0.2", "live")
+	env.allocate(t, "172.16.0.3", "stopped")
+	env.allocate(t, "172.16.0.4", "gone")
+	env.allocate(t, "172.16.0.5", "")
+	writeFile(t, path.Join(env.resultsDir, "tke-bridge-gone-eth0"), `{
+  "kind": "cniCacheV1",
+  "result": {"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "172.16.0.4/24"}]}
+}`, 0644)
+
+	env.reconciler().checkDirtyCNIData()
+
+	if !env.allocated("172.16.0.2") {
+		t.Errorf("ip of ready sandbox is released")
+	}
+	if env.invocation(t, "DEL", "live") != nil {
+		t.Errorf("DEL invoked for ready sandbox")
+	}
+	for _, ip := range []string{"172.16.0.3", "172.16.0.4", "172.16.0.5"} {
+		if env.allocated(ip) {
+			t.Errorf("leaked ip %s is not released", ip)
+		}
+	}
+	if env.invocation(t, "DEL", "stopped") == nil {
+		t.Errorf("DEL not invoked for not ready sandbox")
+	}
+	conf := env.invocation(t, "DEL", "gone")
+	if conf == nil {
+		t.Fatalf("DEL not invoked for removed sandbox")
+	}
+	prevResult, _ := json.Marshal(conf["prevResult"])
+	if !strings.Contains(string(prevResult), "172.16.0.4/24") {
+		t.Errorf("expect cached result passed as prevResult, got %s", prevResult)
+	}
+}
+
+func TestCheckDirtyCNIDataInFlight(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	// cni ADD has written the ip file, the sandbox is not ready yet
+	env.runtime.SetSandbox(fake.Sandbox{Id: "starting", Name: "starting", Namespace: "default"})
+	env.allocateAt(t, "172.16.0.2", "starting", time.Now())
+
+	env.reconciler().checkDirtyCNIData()
+
+	if !env.allocated("172.16.0.2") {
+		t.Errorf("ip of sandbox being set up is released")
+	}
+	if env.invocation(t, "DEL", "starting") != nil {
+		t.Errorf("DEL invoked for sandbox being set up")
+	}
+}
+
+func TestCNIDelFallback(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	// the plugin is missing, so DEL fails and the ip files are removed
+	os.Remove(path.Join(env.dir, "bin", "fake-bridge"))
+	env.allocate(t, "172.16.0.3", "gone")
+
+	env.reconciler().checkDirtyCNIData()
+
+	if env.allocated("172.16.0.3") {
+		t.Errorf("ip is not released by removing its file")
+	}
+}
+
+func TestCheckDirtyCNIDataRuntimeDown(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	env.allocate(t, "172.16.0.2", "live")
+	env.runtime.InjectError("ListPodSandbox", status.Error(codes.Unavailable, "down"))
+
+	env.reconciler().checkDirtyCNIData()
+
+	if !env.allocated("172.16.0.2") {
+		t.Errorf("ip is released while the runtime is down")
+	}
+}
+
+func TestCheckRemovedSandboxes(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.cleanup()
+
+	env.runtime.SetSandbox(fake.Sandbox{Id: "a", Name: "a", Namespace: "default", Ready: true})
+	env.runtime.SetSandbox(fake.Sandbox{Id: "b", Name: "b", Namespace: "default", Ready: true})
+	env.allocate(t, "172.16.0.2", "a")
+	env.allocate(t, "172.16.0.3", "b")
+	// allocated to a sandbox being set up, never seen ready
+	env.allocate(t, "172.16.0.4", "new")
+
+	cr := env.reconciler()
+	cr.checkRemovedSandboxes()
+	env.runtime.RemoveSandbox("b")
+	cr.checkRemovedSandboxes()
+
+	if !env.allocated("172.16.0.2") {
+		t.Errorf("ip of ready sandbox is released")
+	}
+	if env.allocated("172.16.0.3") {
+		t.Errorf("ip of removed sandbox is not released")
+	}
+	if !env.allocated("172.16.0.4") {
+		t.Errorf("ip of sandbox never seen ready is released")
+	}
+}
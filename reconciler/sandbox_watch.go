@@ -0,0 +1,56 @@
+package reconciler
+
+import (
+	log "github.com/golang/glog"
+)
+
+// checkRemovedSandboxes diffs ready sandboxes against the last listing, and
+// releases ips still allocated to sandboxes which have gone since then. Only
+// sandboxes seen ready before are considered, so that ips of sandboxes being
+// set up are never touched.
+func (cr *CniReconciler) checkRemovedSandboxes() {
+	last := cr.readySandboxes
+	if last == nil {
+		// no baseline yet, e.g. the runtime was unreachable at startup
+		if _, err := cr.listReadySandboxes(); err != nil {
+			log.V(4).Infof("cniReconciler: failed to list ready sandboxes: %v", err)
+		}
+		return
+	}
+
+	current, err := cr.listReadySandboxes()
+	if err != nil {
+		log.V(4).Infof("cniReconciler: failed to list ready sandboxes: %v", err)
+		return
+	}
+
+	removed := make(map[string]bool)
+	for id, sandbox := range last {
+		if _, ok := current[id]; !ok {
+			log.Infof("cniReconciler: pod sandbox %s(%s/%s) is gone", id, sandbox.NameSpace, sandbox.PodName)
+			removed[id] = true
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	allocInfo, err := cr.getAllocateSet()
+	if err != nil {
+		log.Errorf("cniReconciler: failed to get cni allocated info: %v", err)
+		return
+	}
+
+	dirty := make(map[allocation][]string)
+	for ip, alloc := range allocInfo {
+		if removed[alloc.containerId] {
+			log.Infof("cniReconciler: find ip %s still allocated to removed pod sandbox(%s), delete it from store",
+				ip, alloc.containerId)
+			dirty[alloc] = append(dirty[alloc], ip)
+		}
+	}
+	if len(dirty) == 0 {
+		return
+	}
+	cr.releaseDirty(cr.crossCheck(dirty))
+}
@@ -0,0 +1,176 @@
+package reconciler
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	DefaultVethGCGracePeriod = 10 * time.Minute
+)
+
+var (
+	bridgePorts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "bridge_ports",
+		Help:      "Number of veth ports on the bridge by whether their peer belongs to a live sandbox.",
+	}, []string{"state"})
+	staleVethsRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "tke_bridge_agent",
+		Name:      "stale_veths_removed_total",
+		Help:      "Number of veth ports removed from the bridge since their sandbox was gone.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(bridgePorts, staleVethsRemoved)
+}
+
+// orphanVeth is a bridge port whose peer belongs to no live sandbox.
+type orphanVeth struct {
+	name      string
+	firstSeen time.Time
+}
+
+// checkStaleVeths removes veths enslaved to the bridge whose peer is not in
+// the netns of any live sandbox, once they have been orphaned for the grace
+// period.
+func (cr *CniReconciler) checkStaleVeths() {
+	bridge, err := netlink.LinkByName(cr.bridgeName)
+	if err != nil {
+		log.V(4).Infof("cniReconciler: bridge %s not found, skip checking veths: %v", cr.bridgeName, err)
+		return
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("cniReconciler: failed to list links: %v", err)
+		return
+	}
+	ports := make(map[int]string)
+	for _, link := range links {
+		if link.Type() == "veth" && link.Attrs().MasterIndex == bridge.Attrs().Index {
+			ports[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+
+	live, complete, err := cr.liveSandboxPorts()
+	if err != nil {
+		log.Errorf("cniReconciler: failed to find bridge ports of live sandboxes, skip checking veths: %v", err)
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[int]bool)
+	var liveCount, orphanCount int
+	for index, name := range ports {
+		if live[index] {
+			liveCount++
+			continue
+		}
+		orphanCount++
+		seen[index] = true
+
+		orphan, ok := cr.orphanVeths[index]
+		if !ok || orphan.name != name {
+			log.Infof("cniReconciler: find veth %s on %s not belonging to any live sandbox", name, cr.bridgeName)
+			cr.orphanVeths[index] = &orphanVeth{name: name, firstSeen: now}
+			continue
+		}
+		if now.Sub(orphan.firstSeen) < cr.vethGCGracePeriod {
+			continue
+		}
+		if !complete {
+			log.Warningf("cniReconciler: netns of some sandboxes unknown, keep orphaned veth %s", name)
+			continue
+		}
+
+		log.Infof("cniReconciler: delete veth %s orphaned since %v", name, orphan.firstSeen)
+		if err := netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: index, Name: name}}); err != nil {
+			log.Errorf("cniReconciler: failed to delete veth %s: %v", name, err)
+			continue
+		}
+		staleVethsRemoved.Inc()
+		delete(cr.orphanVeths, index)
+		delete(seen, index)
+		orphanCount--
+	}
+	for index := range cr.orphanVeths {
+		if !seen[index] {
+			delete(cr.orphanVeths, index)
+		}
+	}
+
+	bridgePorts.WithLabelValues("live").Set(float64(liveCount))
+	bridgePorts.WithLabelValues("orphaned").Set(float64(orphanCount))
+}
+
+// liveSandboxPorts returns the host side ifindex of the veths in the netns of
+// ready sandboxes. complete is false if the netns of some non host-network
+// sandbox is unknown.
+func (cr *CniReconciler) liveSandboxPorts() (ports map[int]bool, complete bool, err error) {
+	sandboxes, err := cr.criClient.GetReadyPodSandboxes()
+	if err != nil {
+		return nil, false, err
+	}
+
+	ports = make(map[int]bool)
+	complete = true
+	for _, sandbox := range sandboxes {
+		status, err := cr.criClient.GetPodSandboxStatus(sandbox.ContainerId)
+		if err != nil {
+			log.Warningf("cniReconciler: failed to get status of sandbox %s: %v", sandbox.ContainerId, err)
+			complete = false
+			continue
+		}
+		if status.HostNetwork {
+			continue
+		}
+		if status.NetNSPath == "" {
+			complete = false
+			continue
+		}
+		peers, err := vethPeers(status.NetNSPath)
+		if err != nil {
+			log.Warningf("cniReconciler: failed to list veths of sandbox %s in %s: %v", sandbox.ContainerId, status.NetNSPath, err)
+			complete = false
+			continue
+		}
+		for _, index := range peers {
+			ports[index] = true
+		}
+	}
+	return ports, complete, nil
+}
+
+// vethPeers returns the ifindex of the peers of every veth in the netns.
+func vethPeers(netnsPath string) ([]int, error) {
+	ns, err := netns.GetFromPath(netnsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get netlink handle: %v", err)
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var peers []int
+	for _, link := range links {
+		if link.Type() == "veth" && link.Attrs().ParentIndex != 0 {
+			peers = append(peers, link.Attrs().ParentIndex)
+		}
+	}
+	return peers, nil
+}
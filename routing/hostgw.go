@@ -0,0 +1,51 @@
+package routing
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+// hostGWRoutes returns the routes to the pod cidrs of peers through their
+// node ips, and the reasons of peers which are not on link, i.e. reached
+// through a gateway, so that their node ips cannot be next hops.
+func (m *Manager) hostGWRoutes(peers []peer) ([]netlink.Route, []string) {
+	var routes []netlink.Route
+	var unroutable []string
+	for _, p := range peers {
+		linkIndex, err := onLink(p)
+		if err != nil {
+			unroutable = append(unroutable, fmt.Sprintf("peer %s: %v", p.name, err))
+			continue
+		}
+		routes = append(routes, netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       p.podCIDR,
+			Gw:        p.ip,
+			Table:     m.config.Table,
+			Protocol:  routeProtocol,
+		})
+	}
+	return routes, unroutable
+}
+
+// onLink returns the interface the node ip of p is directly reached on.
+func onLink(p peer) (int, error) {
+	routes, err := netlink.RouteGet(p.ip)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get route to %s: %v", p.ip, err)
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", p.ip)
+	}
+	route := routes[0]
+	if route.Gw != nil {
+		return 0, fmt.Errorf("node ip %s is reached via gateway %s, not on the same l2 segment", p.ip, route.Gw)
+	}
+	if route.LinkIndex == 0 {
+		return 0, fmt.Errorf("no interface reaching %s", p.ip)
+	}
+	log.V(4).Infof("routing: peer %s is on link %d", p.name, route.LinkIndex)
+	return route.LinkIndex, nil
+}
@@ -0,0 +1,397 @@
+// Package routing routes the pod cidrs of peer nodes for clusters whose
+// underlying network does not, by routes in a table owned by the agent.
+package routing
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qyzhaoxun/tke-bridge-agent/events"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// ModeHostGW routes pod cidrs of peers through their node ips, which
+	// must be on the same l2 segment.
+	ModeHostGW = "host-gw"
+
+	DefaultTable         = 2000
+	DefaultRulePriority  = 2000
+	DefaultCheckInterval = time.Minute
+
+	// routeProtocol tags the routes of the agent, so that routes added to
+	// the table by others are neither replaced nor deleted
+	routeProtocol = 98
+)
+
+var routedPeers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "routing_peers",
+	Help:      "Number of peer nodes by whether their pod cidrs are routed.",
+}, []string{"state"})
+
+func init() {
+	prometheus.MustRegister(routedPeers)
+}
+
+const (
+	peerRouted = "routed"
+	// peerUnroutable are peers routed by other modes, e.g. not on link in
+	// host-gw.
+	peerUnroutable = "unroutable"
+	// peerIncomplete are peers without pod cidr or node ip yet.
+	peerIncomplete = "incomplete"
+)
+
+// Config holds the settings of a Manager.
+type Config struct {
+	// Mode is how the pod cidrs of peers are routed, e.g. ModeHostGW, empty
+	// for a Manager only cleaning up.
+	Mode string
+	// Table is the route table holding the routes, owned by the agent.
+	Table int
+	// RulePriority is the preference of the rule looking up Table.
+	RulePriority int
+	// VNI and VXLANPort are the vni and udp port of the vxlan device in
+	// ModeVXLAN.
+	VNI       int
+	VXLANPort int
+	// CheckInterval is the interval of verifying the routes besides on node
+	// and route changes.
+	CheckInterval time.Duration
+	// Client lists and watches all nodes.
+	Client   kubernetes.Interface
+	NodeName string
+	// Recorder records peers failed to route as events of the node if not
+	// nil.
+	Recorder record.EventRecorder
+}
+
+// peer is a node whose pod cidr is routed.
+type peer struct {
+	name        string
+	podCIDR     *net.IPNet
+	ip          net.IP
+	annotations map[string]string
+}
+
+// Manager routes the pod cidrs of peer nodes.
+type Manager struct {
+	config Config
+
+	nodeStore cache.Store
+	trigger   chan struct{}
+
+	// unroutable are the peers reported last as unroutable, joined
+	unroutable string
+}
+
+// New returns a Manager of config, zero fields are defaulted.
+func New(config Config) (*Manager, error) {
+	switch config.Mode {
+	case ModeHostGW, ModeVXLAN, "":
+	default:
+		return nil, fmt.Errorf("unknown routing mode %q", config.Mode)
+	}
+	if config.Table <= 0 {
+		config.Table = DefaultTable
+	}
+	if config.RulePriority <= 0 {
+		config.RulePriority = DefaultRulePriority
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultCheckInterval
+	}
+	if config.VNI <= 0 {
+		config.VNI = DefaultVNI
+	}
+	if config.VXLANPort <= 0 {
+		config.VXLANPort = DefaultVXLANPort
+	}
+	return &Manager{
+		config:  config,
+		trigger: make(chan struct{}, 1),
+	}, nil
+}
+
+func (m *Manager) kick() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run watches all nodes, and converges the routes whenever a node or a
+// route of the table changes, and every check interval.
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	nodeLW := cache.NewListWatchFromClient(m.config.Client.CoreV1().RESTClient(), "nodes", metav1.NamespaceAll, fields.Everything())
+	kick := func(interface{}) { m.kick() }
+	store, controller := cache.NewInformer(nodeLW, &v1.Node{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    kick,
+		UpdateFunc: func(oldObj, newObj interface{}) { m.kick() },
+		DeleteFunc: kick,
+	})
+	m.nodeStore = store
+	go controller.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, controller.HasSynced) {
+		return
+	}
+
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+
+	var routeCh chan netlink.RouteUpdate
+	m.kick()
+	for {
+		// netlink closes the channel on errors, subscribe again
+		if routeCh == nil {
+			routeCh = make(chan netlink.RouteUpdate)
+			if err := netlink.RouteSubscribe(routeCh, stopCh); err != nil {
+				log.Warningf("routing: failed to subscribe route updates: %v", err)
+				routeCh = nil
+			}
+		}
+
+		select {
+		case <-m.trigger:
+			m.converge()
+		case <-ticker.C:
+			m.converge()
+		case update, ok := <-routeCh:
+			if !ok {
+				routeCh = nil
+				continue
+			}
+			if update.Table == m.config.Table {
+				m.kick()
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) converge() {
+	peers, incomplete := m.peers()
+	var routes []netlink.Route
+	var unroutable []string
+	switch m.config.Mode {
+	case ModeHostGW:
+		routes, unroutable = m.hostGWRoutes(peers)
+	case ModeVXLAN:
+		var err error
+		if routes, unroutable, err = m.vxlanRoutes(peers); err != nil {
+			// keep the routes, which may still work
+			log.Errorf("routing: failed to converge vxlan: %v", err)
+			return
+		}
+	}
+	routedPeers.WithLabelValues(peerRouted).Set(float64(len(routes)))
+	routedPeers.WithLabelValues(peerUnroutable).Set(float64(len(unroutable)))
+	routedPeers.WithLabelValues(peerIncomplete).Set(float64(incomplete))
+	m.reportUnroutable(unroutable)
+
+	if err := m.ensureRoutes(routes); err != nil {
+		log.Errorf("routing: failed to ensure routes: %v", err)
+	}
+	if err := m.ensureRule(); err != nil {
+		log.Errorf("routing: failed to ensure rule: %v", err)
+	}
+}
+
+// peers returns the nodes other than this one with pod cidr and node ip, and
+// the number of the others.
+func (m *Manager) peers() ([]peer, int) {
+	var peers []peer
+	var incomplete int
+	for _, obj := range m.nodeStore.List() {
+		node, ok := obj.(*v1.Node)
+		if !ok || node.Name == m.config.NodeName {
+			continue
+		}
+		p, err := nodePeer(node)
+		if err != nil {
+			log.V(4).Infof("routing: skip node %s: %v", node.Name, err)
+			incomplete++
+			continue
+		}
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].name < peers[j].name })
+	return peers, incomplete
+}
+
+func nodePeer(node *v1.Node) (peer, error) {
+	if node.Spec.PodCIDR == "" {
+		return peer{}, fmt.Errorf("no pod cidr")
+	}
+	_, podCIDR, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return peer{}, err
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != v1.NodeInternalIP {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		if ip != nil && (ip.To4() != nil) == (podCIDR.IP.To4() != nil) {
+			return peer{name: node.Name, podCIDR: podCIDR, ip: ip, annotations: node.Annotations}, nil
+		}
+	}
+	return peer{}, fmt.Errorf("no internal ip of the family of pod cidr %s", podCIDR)
+}
+
+// reportUnroutable logs and records unroutable peers as events if they
+// changed.
+func (m *Manager) reportUnroutable(unroutable []string) {
+	joined := strings.Join(unroutable, "; ")
+	if joined == m.unroutable {
+		return
+	}
+	m.unroutable = joined
+	for _, reason := range unroutable {
+		log.Warningf("routing: %s", reason)
+	}
+	if len(unroutable) > 0 && m.config.Recorder != nil {
+		m.config.Recorder.Eventf(events.NodeReference(m.config.NodeName), v1.EventTypeWarning, "PeerUnroutable",
+			"pod cidrs of peers are not routed: %s", joined)
+	}
+}
+
+// ensureRoutes makes the routes of the agent in the table exactly routes.
+// Routes of others are left alone, even if they take the place of one of
+// routes.
+func (m *Manager) ensureRoutes(routes []netlink.Route) error {
+	current, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: m.config.Table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of table %d: %v", m.config.Table, err)
+	}
+	want := make(map[string]bool)
+	for _, route := range routes {
+		want[routeKey(route)] = true
+	}
+	have := make(map[string]bool)
+	for _, route := range current {
+		if route.Protocol != routeProtocol {
+			continue
+		}
+		if want[routeKey(route)] {
+			have[routeKey(route)] = true
+			continue
+		}
+		log.Infof("routing: delete route %s", describeRoute(route))
+		if err := netlink.RouteDel(&route); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete route %s: %v", describeRoute(route), err)
+		}
+	}
+	for _, route := range routes {
+		if have[routeKey(route)] {
+			continue
+		}
+		log.Infof("routing: add route %s", describeRoute(route))
+		if err := netlink.RouteAdd(&route); err != nil {
+			if isExist(err) {
+				log.Warningf("routing: skip route %s, a route to %v not added by the agent exists", describeRoute(route), route.Dst)
+				continue
+			}
+			return fmt.Errorf("failed to add route %s: %v", describeRoute(route), err)
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the routes of the agent in the table, the rule looking it
+// up and the vxlan device.
+func (m *Manager) Cleanup() error {
+	if err := m.ensureRoutes(nil); err != nil {
+		return err
+	}
+	if err := m.deleteRules(-1); err != nil {
+		return err
+	}
+	return deleteVXLAN()
+}
+
+func routeKey(route netlink.Route) string {
+	return fmt.Sprintf("%v/%v/%d", route.Dst, route.Gw, route.LinkIndex)
+}
+
+func describeRoute(route netlink.Route) string {
+	return fmt.Sprintf("%v via %v dev %d", route.Dst, route.Gw, route.LinkIndex)
+}
+
+// ensureRule adds the rule looking up the table for all traffic, where
+// destinations not routed by the table fall through to later rules.
+func (m *Manager) ensureRule() error {
+	if err := m.deleteRules(m.config.RulePriority); err != nil {
+		return err
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, rule := range rules {
+		if m.isTableRule(rule) {
+			return nil
+		}
+	}
+	rule := netlink.NewRule()
+	rule.Priority = m.config.RulePriority
+	rule.Table = m.config.Table
+	log.Infof("routing: add rule pref %d lookup %d", rule.Priority, rule.Table)
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("failed to add rule pref %d lookup %d: %v", rule.Priority, rule.Table, err)
+	}
+	return nil
+}
+
+// deleteRules deletes the rules looking up the table at preferences other
+// than keep.
+func (m *Manager) deleteRules(keep int) error {
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, rule := range rules {
+		if !m.isTableRule(rule) || rule.Priority == keep {
+			continue
+		}
+		log.Infof("routing: delete rule pref %d lookup %d", rule.Priority, rule.Table)
+		if err := netlink.RuleDel(&rule); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete rule pref %d lookup %d: %v", rule.Priority, rule.Table, err)
+		}
+	}
+	return nil
+}
+
+// isTableRule tells whether rule looks up the table for all traffic.
+func (m *Manager) isTableRule(rule netlink.Rule) bool {
+	return rule.Table == m.config.Table && rule.Src == nil && rule.Dst == nil && rule.Mark < 0 && rule.IifName == "" && rule.OifName == ""
+}
+
+func isNotFound(err error) bool {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno == syscall.ENOENT || errno == syscall.ESRCH
+	}
+	return false
+}
+
+func isExist(err error) bool {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno == syscall.EEXIST
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// ModeVXLAN routes pod cidrs of peers through a vxlan device, for peers
+	// in other subnets.
+	ModeVXLAN = "vxlan"
+
+	VXLANDevice      = "tke.vxlan"
+	DefaultVNI       = 1
+	DefaultVXLANPort = 8472
+	// VXLANOverhead is the outer ipv4, udp, vxlan and ethernet headers.
+	VXLANOverhead = 50
+
+	// AnnotationVTEPMAC and AnnotationVTEPIP publish the vxlan device of a
+	// node to peers.
+	AnnotationVTEPMAC = "tke.cloud.tencent.com/bridge-vtep-mac"
+	AnnotationVTEPIP  = "tke.cloud.tencent.com/bridge-vtep-ip"
+)
+
+// vxlanRoutes creates the vxlan device of this node and publishes it, then
+// programs the neighbor and fdb entries of peers, and returns the routes to
+// the pod cidrs of peers through the device, and the reasons of peers not
+// publishing their devices yet.
+func (m *Manager) vxlanRoutes(peers []peer) ([]netlink.Route, []string, error) {
+	obj, exists, err := m.nodeStore.GetByKey(m.config.NodeName)
+	if err != nil || !exists {
+		return nil, nil, fmt.Errorf("node %s is not found: %v", m.config.NodeName, err)
+	}
+	node := obj.(*v1.Node)
+	self, err := nodePeer(node)
+	if err != nil {
+		return nil, nil, fmt.Errorf("node %s: %v", node.Name, err)
+	}
+	link, err := m.ensureVXLAN(self)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.publishVTEP(node, link.Attrs().HardwareAddr, self.ip); err != nil {
+		return nil, nil, err
+	}
+
+	var routes []netlink.Route
+	var neighs, fdbs []netlink.Neigh
+	var unroutable []string
+	for _, p := range peers {
+		mac, err := net.ParseMAC(p.annotations[AnnotationVTEPMAC])
+		vtepIP := net.ParseIP(p.annotations[AnnotationVTEPIP])
+		if err != nil || vtepIP == nil {
+			unroutable = append(unroutable, fmt.Sprintf("peer %s: no valid vtep annotations", p.name))
+			continue
+		}
+		// the vxlan device of the peer holds the network address of its
+		// pod cidr, which is the next hop
+		gw := p.podCIDR.IP.Mask(p.podCIDR.Mask)
+		routes = append(routes, netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       p.podCIDR,
+			Gw:        gw,
+			Flags:     int(netlink.FLAG_ONLINK),
+			Table:     m.config.Table,
+			Protocol:  routeProtocol,
+		})
+		neighs = append(neighs, netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           gw,
+			HardwareAddr: mac,
+		})
+		fdbs = append(fdbs, netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           vtepIP,
+			HardwareAddr: mac,
+		})
+	}
+	if err := ensureNeighbors(link, netlink.FAMILY_V4, neighs); err != nil {
+		return nil, nil, err
+	}
+	if err := ensureNeighbors(link, unix.AF_BRIDGE, fdbs); err != nil {
+		return nil, nil, err
+	}
+	return routes, unroutable, nil
+}
+
+// ensureVXLAN creates the vxlan device over the interface of the node ip,
+// recreating it if its settings differ, and assigns it the network address
+// of the pod cidr.
+func (m *Manager) ensureVXLAN(self peer) (netlink.Link, error) {
+	parent, err := linkOfIP(self.ip)
+	if err != nil {
+		return nil, err
+	}
+	mtu := parent.Attrs().MTU - VXLANOverhead
+
+	link, err := netlink.LinkByName(VXLANDevice)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, fmt.Errorf("failed to get %s: %v", VXLANDevice, err)
+		}
+		link = nil
+	}
+	if vxlan, ok := link.(*netlink.Vxlan); link != nil && (!ok || vxlan.VxlanId != m.config.VNI ||
+		vxlan.Port != m.config.VXLANPort || vxlan.VtepDevIndex != parent.Attrs().Index || !vxlan.SrcAddr.Equal(self.ip)) {
+		log.Infof("routing: recreate %s with vni %d port %d over %s", VXLANDevice, m.config.VNI, m.config.VXLANPort, parent.Attrs().Name)
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %v", VXLANDevice, err)
+		}
+		link = nil
+	}
+	if link == nil {
+		log.Infof("routing: create %s with vni %d port %d over %s", VXLANDevice, m.config.VNI, m.config.VXLANPort, parent.Attrs().Name)
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: VXLANDevice,
+				MTU:  mtu,
+			},
+			VxlanId:      m.config.VNI,
+			VtepDevIndex: parent.Attrs().Index,
+			SrcAddr:      self.ip,
+			Port:         m.config.VXLANPort,
+		}
+		if err := netlink.LinkAdd(vxlan); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", VXLANDevice, err)
+		}
+		if link, err = netlink.LinkByName(VXLANDevice); err != nil {
+			return nil, fmt.Errorf("failed to get %s: %v", VXLANDevice, err)
+		}
+	}
+
+	if link.Attrs().MTU != mtu {
+		log.Infof("routing: set mtu of %s from %d to %d", VXLANDevice, link.Attrs().MTU, mtu)
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return nil, fmt.Errorf("failed to set mtu of %s: %v", VXLANDevice, err)
+		}
+	}
+	addr := &netlink.Addr{IPNet: &net.IPNet{
+		IP:   self.podCIDR.IP.Mask(self.podCIDR.Mask),
+		Mask: net.CIDRMask(32, 32),
+	}}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s: %v", VXLANDevice, err)
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			addr = nil
+			continue
+		}
+		log.Infof("routing: delete address %s of %s", a.IPNet, VXLANDevice)
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return nil, fmt.Errorf("failed to delete address %s of %s: %v", a.IPNet, VXLANDevice, err)
+		}
+	}
+	if addr != nil {
+		log.Infof("routing: add address %s to %s", addr.IPNet, VXLANDevice)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return nil, fmt.Errorf("failed to add address %s to %s: %v", addr.IPNet, VXLANDevice, err)
+		}
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("failed to set %s up: %v", VXLANDevice, err)
+		}
+	}
+	return link, nil
+}
+
+// VXLANMTU returns the mtu of the vxlan device of node, i.e. the mtu of the
+// interface holding its internal ip less the vxlan overhead.
+func VXLANMTU(node *v1.Node) (int, error) {
+	for _, addr := range node.Status.Addresses {
+		ip := net.ParseIP(addr.Address)
+		if addr.Type != v1.NodeInternalIP || ip.To4() == nil {
+			continue
+		}
+		parent, err := linkOfIP(ip)
+		if err != nil {
+			return 0, err
+		}
+		return parent.Attrs().MTU - VXLANOverhead, nil
+	}
+	return 0, fmt.Errorf("no ipv4 internal ip of node %s", node.Name)
+}
+
+// linkOfIP returns the interface holding ip.
+func linkOfIP(ip net.IP) (netlink.Link, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface holds node ip %s", ip)
+}
+
+// publishVTEP annotates node with the mac and ip of its vxlan device.
+func (m *Manager) publishVTEP(node *v1.Node, mac net.HardwareAddr, ip net.IP) error {
+	annotations := map[string]string{
+		AnnotationVTEPMAC: mac.String(),
+		AnnotationVTEPIP:  ip.String(),
+	}
+	published := true
+	for k, v := range annotations {
+		published = published && node.Annotations[k] == v
+	}
+	if published {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("routing: publish vtep %s %s of node %s", mac, ip, node.Name)
+	if _, err := m.config.Client.CoreV1().Nodes().Patch(node.Name, types.MergePatchType, patch); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+// ensureNeighbors makes the permanent entries of family on link exactly
+// neighs.
+func ensureNeighbors(link netlink.Link, family int, neighs []netlink.Neigh) error {
+	current, err := netlink.NeighList(link.Attrs().Index, family)
+	if err != nil {
+		return fmt.Errorf("failed to list neighbors of %s: %v", link.Attrs().Name, err)
+	}
+	want := make(map[string]bool)
+	for _, neigh := range neighs {
+		want[neighKey(neigh)] = true
+	}
+	have := make(map[string]bool)
+	for _, neigh := range current {
+		if neigh.State&netlink.NUD_PERMANENT == 0 || neigh.IP == nil {
+			continue
+		}
+		if want[neighKey(neigh)] {
+			have[neighKey(neigh)] = true
+			continue
+		}
+		log.Infof("routing: delete neighbor %s of %s", neigh.String(), link.Attrs().Name)
+		neigh.Family = family
+		if err := netlink.NeighDel(&neigh); err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete neighbor %s: %v", neigh.String(), err)
+		}
+	}
+	for _, neigh := range neighs {
+		if have[neighKey(neigh)] {
+			continue
+		}
+		log.Infof("routing: set neighbor %s of %s", neigh.String(), link.Attrs().Name)
+		if err := netlink.NeighSet(&neigh); err != nil {
+			return fmt.Errorf("failed to set neighbor %s: %v", neigh.String(), err)
+		}
+	}
+	return nil
+}
+
+func neighKey(neigh netlink.Neigh) string {
+	return fmt.Sprintf("%s/%s", neigh.IP, neigh.HardwareAddr)
+}
+
+// deleteVXLAN deletes the vxlan device if exists.
+func deleteVXLAN() error {
+	link, err := netlink.LinkByName(VXLANDevice)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to get %s: %v", VXLANDevice, err)
+	}
+	log.Infof("routing: delete %s", VXLANDevice)
+	return netlink.LinkDel(link)
+}
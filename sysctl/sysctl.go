@@ -0,0 +1,279 @@
+// Package sysctl keeps the kernel parameters the bridge network relies on
+// set, re-applying them whenever someone else resets them.
+package sysctl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qyzhaoxun/tke-bridge-agent/events"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	DefaultCheckInterval = time.Minute
+
+	procSys = "/proc/sys"
+)
+
+var sysctlDrifts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "tke_bridge_agent",
+	Name:      "sysctl_drifts_total",
+	Help:      "Number of times a managed sysctl was found changed and re-applied.",
+}, []string{"name"})
+
+func init() {
+	prometheus.MustRegister(sysctlDrifts)
+}
+
+// Sysctl is a kernel parameter and its required value.
+type Sysctl struct {
+	// Name is the dotted name, e.g. net.ipv4.ip_forward.
+	Name  string
+	Value string
+	// AtLeast accepts any current value not less than Value, for limits
+	// which may have been raised by others.
+	AtLeast bool
+	// Optional sysctls are skipped while missing, e.g. those of an interface
+	// not created yet.
+	Optional bool
+	// Required sysctls fail Ensure if not applied, failures of others are
+	// only logged.
+	Required bool
+}
+
+func (s Sysctl) String() string {
+	if s.AtLeast {
+		return fmt.Sprintf("%s>=%s", s.Name, s.Value)
+	}
+	return fmt.Sprintf("%s=%s", s.Name, s.Value)
+}
+
+// Defaults returns the sysctls required by pods on bridgeName, uplink is the
+// interface of the default route whose rp_filter is loosened, skipped if
+// empty. Only bridge-nf-call-iptables is Required, as it always has been.
+func Defaults(bridgeName, uplink string) []Sysctl {
+	sysctls := []Sysctl{
+		{Name: "net.bridge.bridge-nf-call-iptables", Value: "1", Required: true},
+		{Name: "net.bridge.bridge-nf-call-ip6tables", Value: "1"},
+		{Name: "net.ipv4.ip_forward", Value: "1"},
+		// loose mode, since the effective value is the max of all and the
+		// interface
+		{Name: fmt.Sprintf("net.ipv4.conf.%s.rp_filter", dotted(bridgeName)), Value: "2", Optional: true},
+		{Name: "net.ipv4.neigh.default.gc_thresh1", Value: "1024", AtLeast: true},
+		{Name: "net.ipv4.neigh.default.gc_thresh2", Value: "4096", AtLeast: true},
+		{Name: "net.ipv4.neigh.default.gc_thresh3", Value: "8192", AtLeast: true},
+	}
+	if uplink != "" {
+		sysctls = append(sysctls, Sysctl{Name: fmt.Sprintf("net.ipv4.conf.%s.rp_filter", dotted(uplink)), Value: "2", Optional: true})
+	}
+	return sysctls
+}
+
+// Parse parses name=value, or name>=value for AtLeast whose value must be
+// an integer.
+func Parse(s string) (Sysctl, error) {
+	var sysctl Sysctl
+	if i := strings.Index(s, ">="); i > 0 {
+		sysctl = Sysctl{Name: strings.TrimSpace(s[:i]), Value: strings.TrimSpace(s[i+2:]), AtLeast: true}
+	} else if i := strings.Index(s, "="); i > 0 {
+		sysctl = Sysctl{Name: strings.TrimSpace(s[:i]), Value: strings.TrimSpace(s[i+1:])}
+	} else {
+		return Sysctl{}, fmt.Errorf("invalid sysctl %q, expect name=value or name>=value", s)
+	}
+	if !validName(sysctl.Name) {
+		return Sysctl{}, fmt.Errorf("invalid sysctl name %q", sysctl.Name)
+	}
+	if sysctl.Value == "" {
+		return Sysctl{}, fmt.Errorf("empty value of sysctl %s", sysctl.Name)
+	}
+	if _, err := strconv.ParseInt(sysctl.Value, 10, 64); sysctl.AtLeast && err != nil {
+		return Sysctl{}, fmt.Errorf("invalid sysctl %q, expect an integer after >=", s)
+	}
+	return sysctl, nil
+}
+
+// validName tells whether name is a dotted name of at least two parts, whose
+// path stays under /proc/sys.
+func validName(name string) bool {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "/") != part || strings.Contains(part, "//") {
+			return false
+		}
+		for _, r := range part {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-/", r)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Merge returns defaults overridden by additions of the same name, which
+// stay Required if the default is.
+func Merge(defaults, additions []Sysctl) []Sysctl {
+	index := make(map[string]int)
+	var merged []Sysctl
+	for _, s := range append(append([]Sysctl{}, defaults...), additions...) {
+		if i, ok := index[s.Name]; ok {
+			s.Required = s.Required || merged[i].Required
+			merged[i] = s
+			continue
+		}
+		index[s.Name] = len(merged)
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// Uplink returns the interface of the ipv4 default route.
+func Uplink() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		link, err := netlink.LinkByIndex(route.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", fmt.Errorf("no default route")
+}
+
+// dotted converts an interface name to its form in dotted sysctl names,
+// where dots are written as slashes.
+func dotted(name string) string {
+	return strings.Replace(name, ".", "/", -1)
+}
+
+// sysctlPath returns the /proc/sys path of a dotted name, see sysctl(8).
+func sysctlPath(name string) string {
+	return path.Join(procSys, strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, name))
+}
+
+// Manager applies sysctls and keeps them applied.
+type Manager struct {
+	sysctls       []Sysctl
+	checkInterval time.Duration
+	nodeName      string
+	recorder      record.EventRecorder
+}
+
+// New returns a Manager of sysctls, drifts are recorded as events of
+// nodeName if recorder is not nil.
+func New(sysctls []Sysctl, checkInterval time.Duration, nodeName string, recorder record.EventRecorder) *Manager {
+	return &Manager{
+		sysctls:       sysctls,
+		checkInterval: checkInterval,
+		nodeName:      nodeName,
+		recorder:      recorder,
+	}
+}
+
+// Ensure applies every sysctl not having the required value, and returns the
+// Required sysctls failed to apply.
+func (m *Manager) Ensure() error {
+	var failed []string
+	for _, s := range m.sysctls {
+		if err := m.ensure(s, false); err != nil {
+			log.Errorf("sysctl: %v", err)
+			if s.Required {
+				failed = append(failed, s.Name)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to apply sysctls %v", failed)
+	}
+	return nil
+}
+
+// Run verifies the sysctls every check interval, and re-applies changed
+// ones.
+func (m *Manager) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range m.sysctls {
+				if err := m.ensure(s, true); err != nil {
+					log.Errorf("sysctl: %v", err)
+				}
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (m *Manager) ensure(s Sysctl, drift bool) error {
+	p := sysctlPath(s.Name)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) && s.Optional {
+			log.V(4).Infof("sysctl: %s does not exist yet, skip it", s.Name)
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %v", s.Name, err)
+	}
+	current := strings.TrimSpace(string(data))
+	if satisfied(s, current) {
+		return nil
+	}
+
+	if drift {
+		log.Warningf("sysctl: %s was changed to %s, set it back to %s", s.Name, current, s.Value)
+		sysctlDrifts.WithLabelValues(s.Name).Inc()
+		if m.recorder != nil {
+			m.recorder.Eventf(events.NodeReference(m.nodeName), v1.EventTypeWarning, "SysctlDrift",
+				"sysctl %s was changed to %s, set it back to %s", s.Name, current, s.Value)
+		}
+	} else {
+		log.Infof("sysctl: set %s from %s to %s", s.Name, current, s.Value)
+	}
+	if err := ioutil.WriteFile(p, []byte(s.Value), 0644); err != nil {
+		return fmt.Errorf("failed to set %s to %s: %v", s.Name, s.Value, err)
+	}
+	return nil
+}
+
+func satisfied(s Sysctl, current string) bool {
+	// multi-valued sysctls are separated by tabs in /proc/sys
+	if strings.Join(strings.Fields(current), " ") == strings.Join(strings.Fields(s.Value), " ") {
+		return true
+	}
+	if !s.AtLeast {
+		return false
+	}
+	want, err1 := strconv.ParseInt(s.Value, 10, 64)
+	got, err2 := strconv.ParseInt(current, 10, 64)
+	return err1 == nil && err2 == nil && got >= want
+}
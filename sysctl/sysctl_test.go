@@ -0,0 +1,96 @@
+package sysctl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		spec   string
+		expect Sysctl
+		err    bool
+	}{
+		{spec: "net.ipv4.ip_forward=1", expect: Sysctl{Name: "net.ipv4.ip_forward", Value: "1"}},
+		{spec: " net.ipv4.ip_forward = 1 ", expect: Sysctl{Name: "net.ipv4.ip_forward", Value: "1"}},
+		{spec: "net.core.somaxconn>=32768", expect: Sysctl{Name: "net.core.somaxconn", Value: "32768", AtLeast: true}},
+		{spec: "net.ipv4.conf.eth0/100.rp_filter=2", expect: Sysctl{Name: "net.ipv4.conf.eth0/100.rp_filter", Value: "2"}},
+		{spec: "net.ipv4.tcp_rmem=4096 87380 6291456", expect: Sysctl{Name: "net.ipv4.tcp_rmem", Value: "4096 87380 6291456"}},
+		{spec: "net.ipv4.ip_forward", err: true},
+		{spec: "=1", err: true},
+		{spec: ">=1", err: true},
+		{spec: "net.ipv4.ip_forward=", err: true},
+		{spec: "ip_forward=1", err: true},
+		{spec: "net..ip_forward=1", err: true},
+		{spec: "net.ipv4.conf./eth0.rp_filter=2", err: true},
+		{spec: "net.ipv4.conf.a//b.rp_filter=2", err: true},
+		{spec: "net.ipv4.conf.all rp_filter=2", err: true},
+		{spec: "net.core.somaxconn>=many", err: true},
+	} {
+		s, err := Parse(c.spec)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expect error, got %+v", c.spec, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.spec, err)
+			continue
+		}
+		if s != c.expect {
+			t.Errorf("%q: expect %+v, got %+v", c.spec, c.expect, s)
+		}
+	}
+}
+
+func TestSatisfied(t *testing.T) {
+	for _, c := range []struct {
+		sysctl  Sysctl
+		current string
+		expect  bool
+	}{
+		{Sysctl{Value: "1"}, "1", true},
+		{Sysctl{Value: "1"}, "0", false},
+		{Sysctl{Value: "1"}, "2", false},
+		{Sysctl{Value: "4096 87380 6291456"}, "4096\t87380\t6291456", true},
+		{Sysctl{Value: "1024", AtLeast: true}, "1024", true},
+		{Sysctl{Value: "1024", AtLeast: true}, "2048", true},
+		{Sysctl{Value: "1024", AtLeast: true}, "512", false},
+		{Sysctl{Value: "1024", AtLeast: true}, "", false},
+	} {
+		if got := satisfied(c.sysctl, c.current); got != c.expect {
+			t.Errorf("%s with %q: expect %v, got %v", c.sysctl, c.current, c.expect, got)
+		}
+	}
+}
+
+func TestSysctlPath(t *testing.T) {
+	for name, expect := range map[string]string{
+		"net.ipv4.ip_forward":              "/proc/sys/net/ipv4/ip_forward",
+		"net.ipv4.conf.eth0/100.rp_filter": "/proc/sys/net/ipv4/conf/eth0.100/rp_filter",
+	} {
+		if got := sysctlPath(name); got != expect {
+			t.Errorf("%s: expect %s, got %s", name, expect, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	defaults := []Sysctl{
+		{Name: "net.bridge.bridge-nf-call-iptables", Value: "1", Required: true},
+		{Name: "net.ipv4.ip_forward", Value: "1"},
+	}
+	additions := []Sysctl{
+		{Name: "net.bridge.bridge-nf-call-iptables", Value: "1", AtLeast: true},
+		{Name: "net.core.somaxconn", Value: "32768", AtLeast: true},
+	}
+	expect := []Sysctl{
+		{Name: "net.bridge.bridge-nf-call-iptables", Value: "1", AtLeast: true, Required: true},
+		{Name: "net.ipv4.ip_forward", Value: "1"},
+		{Name: "net.core.somaxconn", Value: "32768", AtLeast: true},
+	}
+	if got := Merge(defaults, additions); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %+v, got %+v", expect, got)
+	}
+}